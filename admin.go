@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+)
+
+const cacheUsage = `Usage: bronya cache <command> [options]
+
+Commands:
+  list      list cached responses, filtered by -key, -prefix, -vhost or -tag
+  show      print a cached response's metadata and headers (-key)
+  purge     remove cached responses matching -key, -prefix, -vhost or -tag, or -all
+  stats     print cache statistics
+`
+
+// cacheCommand 通过管理接口查看和清除 FastCGI 响应缓存
+func cacheCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return 2
+	}
+	sub, args := args[0], args[1:]
+	switch sub {
+	case "list", "show", "purge", "stats":
+	default:
+		fmt.Fprint(os.Stderr, cacheUsage)
+		return 2
+	}
+
+	flags, path := newFlagSet("cache " + sub)
+	token := flags.String("token", "", "admin API token (overrides config)")
+	insecure := flags.Bool("k", false, "skip TLS certificate verification")
+	params := url.Values{}
+	var all bool
+	if sub != "stats" {
+		for _, name := range []string{"key", "prefix", "vhost", "tag"} {
+			if sub == "show" && name != "key" {
+				continue
+			}
+			name := name
+			flags.Func(name, "match entries by "+name, func(v string) error {
+				params.Set(name, v)
+				return nil
+			})
+		}
+	}
+	if sub == "purge" {
+		flags.BoolVar(&all, "all", false, "purge every entry")
+	}
+	flags.Parse(args)
+
+	conf, err := config.Decode(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, *path+":", err)
+		return 1
+	}
+	client, base, err := adminClient(conf.AdminListener(), *insecure)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *token == "" {
+		*token = conf.Admin.Token
+	}
+
+	var req *http.Request
+	switch sub {
+	case "list":
+		req, err = http.NewRequest("GET", base+"/cache/entries?"+params.Encode(), nil)
+	case "show":
+		if params.Get("key") == "" {
+			fmt.Fprintln(os.Stderr, "bronya cache show: -key is required")
+			return 2
+		}
+		req, err = http.NewRequest("GET", base+"/cache/entry?"+params.Encode(), nil)
+	case "purge":
+		if len(params) == 0 && !all {
+			fmt.Fprintln(os.Stderr, "bronya cache purge: one of -key, -prefix, -vhost, -tag or -all is required")
+			return 2
+		}
+		if all {
+			params.Set("all", "1")
+		}
+		req, err = http.NewRequest("POST", base+"/cache/purge", strings.NewReader(params.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	case "stats":
+		req, err = http.NewRequest("GET", base+"/cache/stats", nil)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	body, err := adminDo(client, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bronya cache "+sub+":", err)
+		return 1
+	}
+
+	switch sub {
+	case "list":
+		var entries []struct {
+			URL   string
+			Vhost string
+			Code  int
+			Size  int64
+			Age   int64
+			TTL   int64
+		}
+		if err := json.Unmarshal(body, &entries); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "AGE\tTTL\tSIZE\tCODE\tVHOST\tURL")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%ds\t%ds\t%d\t%d\t%s\t%s\n", e.Age, e.TTL, e.Size, e.Code, e.Vhost, e.URL)
+		}
+		w.Flush()
+	case "purge":
+		var result struct{ Purged int }
+		if err := json.Unmarshal(body, &result); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("purged %d entries\n", result.Purged)
+	default:
+		os.Stdout.Write(body)
+	}
+	return 0
+}
+
+// logLevel 通过管理接口查看或修改运行中服务器的日志级别
+func logLevel(args []string) int {
+	flags, path := newFlagSet("log-level")
+	token := flags.String("token", "", "admin API token (overrides config)")
+	insecure := flags.Bool("k", false, "skip TLS certificate verification")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: bronya log-level [options] [debug|info|warn|error]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	conf, err := config.Decode(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, *path+":", err)
+		return 1
+	}
+	client, base, err := adminClient(conf.AdminListener(), *insecure)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *token == "" {
+		*token = conf.Admin.Token
+	}
+
+	var req *http.Request
+	if flags.NArg() > 0 {
+		form := url.Values{"level": {flags.Arg(0)}}
+		req, err = http.NewRequest("POST", base+"/log/level", strings.NewReader(form.Encode()))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest("GET", base+"/log/level", nil)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	body, err := adminDo(client, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bronya log-level:", err)
+		return 1
+	}
+	var result struct{ Level string }
+	if err := json.Unmarshal(body, &result); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(result.Level)
+	return 0
+}
+
+// adminDo 发送管理接口请求，返回成功响应的内容或者接口返回的错误
+func adminDo(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		var e struct{ Error string }
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return nil, errors.New(e.Error)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return body, nil
+}
+
+// adminClient 创建连接管理接口监听器的 HTTP 客户端，返回客户端和基础 URL
+func adminClient(ln *config.Listener, insecure bool) (*http.Client, string, error) {
+	if ln == nil {
+		return nil, "", errors.New("the admin API is not configured, set admin.listener in the config file")
+	}
+
+	network, addr := ln.Network(), ln.Addr()
+	if network == "tcp" {
+		// 监听所有地址时连接本机
+		switch ln.Address {
+		case "", "0.0.0.0":
+			addr = net.JoinHostPort("127.0.0.1", ln.Port)
+		case "::", "[::]":
+			addr = net.JoinHostPort("::1", ln.Port)
+		}
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+	}
+
+	scheme := "http"
+	if ln.TLS() {
+		scheme = "https"
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, scheme + "://localhost", nil
+}
@@ -1,11 +1,131 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kotoyuuko/bronya/config"
 	"github.com/kotoyuuko/bronya/logger"
 	"github.com/kotoyuuko/bronya/server"
 )
 
+const usage = `Usage: bronya <command> [options]
+
+Commands:
+  serve     start the server (default)
+  check     parse and validate the config file
+  reload    ask the running server to reload its config
+  reopen    ask the running server to reopen its log files
+  upgrade   ask the running server to hand over to a new binary
+  stop      ask the running server to shut down gracefully
+  cache     list, inspect and purge cached FastCGI responses
+  log-level show or change the running server's log level
+  version   print the version
+  import-nginx <nginx.conf>
+            convert nginx server blocks into a Bronya config
+
+Run 'bronya <command> -h' for command options.
+`
+
 func main() {
+	cmd := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		cmd, args = args[0], args[1:]
+	}
+
+	commands := map[string]func([]string) int{
+		"serve":   serve,
+		"check":   check,
+		"reload":  signalCommand("reload"),
+		"reopen":  signalCommand("reopen"),
+		"upgrade": signalCommand("upgrade"),
+		"stop":    signalCommand("stop"),
+		"version": version,
+		"cache":   cacheCommand,
+
+		"log-level":    logLevel,
+		"import-nginx": importNginx,
+	}
+
+	run, ok := commands[cmd]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	os.Exit(run(args))
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("bronya "+name, flag.ExitOnError)
+	path := flags.String("c", config.Path, "path to the config file")
+	return flags, path
+}
+
+func serve(args []string) int {
+	flags, path := newFlagSet("serve")
+	pid := flags.String("p", "", "path to the pid file (overrides config)")
+	flags.Parse(args)
+
 	logger.Info.Println("Bronya Starting...")
-	server.Fire()
+
+	config.Path = *path
+	problems, err := config.Reload()
+	for _, w := range problems.Warnings() {
+		logger.Warning.Println(w)
+	}
+	if err != nil {
+		logger.Error.Println("Invalid config file " + *path + ":\n" + err.Error())
+		return 1
+	}
+	conf := config.Current()
+
+	if err := logger.Init(server.LogOptions(conf.Log)); err != nil {
+		logger.Error.Println(err)
+		return 1
+	}
+
+	pidFile := conf.Pid
+	if *pid != "" {
+		pidFile = *pid
+	}
+	if err := server.Fire(pidFile); err != nil {
+		logger.Error.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func check(args []string) int {
+	flags, path := newFlagSet("check")
+	flags.Parse(args)
+
+	conf, problems, err := config.Load(*path)
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, *path+": "+p.String())
+	}
+	if err != nil {
+		if _, ok := err.(config.Problems); !ok {
+			fmt.Fprintln(os.Stderr, *path+":", err)
+		}
+		return 1
+	}
+
+	fmt.Println("Listeners:")
+	for _, ln := range conf.Listeners {
+		fmt.Printf("  %s  %s://%s  %s\n", ln.Name, ln.Network(), ln.Addr(), ln.Protocol)
+	}
+	fmt.Println("Vhosts:")
+	for _, host := range conf.Vhosts {
+		fmt.Printf("  %v  root=%s  index=%v  listeners=%v\n", host.Name, host.Root, host.Index, host.Listeners)
+	}
+	fmt.Printf("  (default)  root=%s  index=%v  listeners=%v\n", conf.Default.Root, conf.Default.Index, conf.Default.Listeners)
+	fmt.Println(*path + ": ok")
+	return 0
+}
+
+func version(args []string) int {
+	fmt.Println("Bronya/" + server.Version)
+	return 0
 }
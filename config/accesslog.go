@@ -0,0 +1,265 @@
+package config
+
+import (
+	"errors"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/kotoyuuko/bronya/netutil"
+)
+
+// 预定义的访问日志格式
+var logFormats = map[string]string{
+	"common":   `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`,
+	"combined": `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+}
+
+// logVariables 访问日志模板中可以使用的变量，另外还可以使用 http_*、sent_http_*、cookie_* 和 arg_*
+var logVariables = []string{
+	"remote_addr", "remote_port", "peer_addr", "remote_user",
+	"time_local", "time_iso8601", "msec",
+	"request", "request_method", "request_uri", "uri", "args", "server_protocol",
+	"status", "body_bytes_sent", "bytes_sent", "request_length", "request_time",
+	"host", "server_port", "vhost", "listener", "scheme", "request_id",
+}
+
+var logVariablePrefixes = []string{"http_", "sent_http_", "cookie_", "arg_"}
+
+// LogToken 是访问日志模板的组成部分，Var 为空时为字面量
+type LogToken struct {
+	Literal string
+	Var     string
+}
+
+// AccessLog 存储访问日志的配置
+type AccessLog struct {
+	Path   string
+	Format string
+	Buffer int
+	Flush  int
+	Skip   []logCondition
+	Rotate Rotate
+
+	// Tokens 为编译后的模板，Format 为 json 时为空
+	Tokens []LogToken `json:"-"`
+}
+
+// logCondition 描述不需要记录的请求，所有非空字段都匹配时跳过
+type logCondition struct {
+	Status   []string
+	Methods  []string
+	Paths    []string
+	Clients  []string
+	Networks []*net.IPNet `json:"-"`
+}
+
+func (l *AccessLog) normalize() {
+	if l.Format == "" {
+		l.Format = "combined"
+	}
+	if l.Buffer == 0 {
+		l.Buffer = 64 << 10
+	}
+	if l.Flush == 0 {
+		l.Flush = 1
+	}
+	if l.Format != "json" {
+		l.Tokens, _ = ParseLogFormat(l.Format)
+	}
+	for i := range l.Skip {
+		l.Skip[i].Networks, _ = netutil.ParseCIDRs(l.Skip[i].Clients)
+	}
+}
+
+// Disabled 判断是否关闭访问日志
+func (l *AccessLog) Disabled() bool {
+	return l.Path == "" || l.Path == "off"
+}
+
+// Skipped 判断请求是否匹配 skip 中的任意一条条件
+func (l *AccessLog) Skipped(status int, method, file string, client net.IP) bool {
+	for i := range l.Skip {
+		if l.Skip[i].match(status, method, file, client) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *logCondition) match(status int, method, file string, client net.IP) bool {
+	if len(c.Status) > 0 {
+		code, matched := strconv.Itoa(status), false
+		for _, pattern := range c.Status {
+			if strings.EqualFold(pattern, code) || len(pattern) == 3 && strings.EqualFold(pattern[1:], "xx") && pattern[0] == code[0] {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(c.Methods) > 0 && !containsFold(c.Methods, method) {
+		return false
+	}
+	if len(c.Paths) > 0 {
+		matched := false
+		for _, pattern := range c.Paths {
+			if ok, _ := path.Match(pattern, file); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(c.Networks) > 0 && !netutil.ContainsIP(c.Networks, client) {
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseLogFormat 将预定义格式名称或者包含 $变量 的模板编译为 LogToken
+func ParseLogFormat(format string) ([]LogToken, error) {
+	if f, ok := logFormats[format]; ok {
+		format = f
+	}
+
+	var tokens []LogToken
+	var literal strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '$' {
+			literal.WriteByte(format[i])
+			continue
+		}
+		if i+1 < len(format) && format[i+1] == '$' {
+			literal.WriteByte('$')
+			i++
+			continue
+		}
+
+		var name string
+		if i+1 < len(format) && format[i+1] == '{' {
+			end := strings.IndexByte(format[i:], '}')
+			if end < 0 {
+				return nil, errors.New("unterminated ${ at offset " + strconv.Itoa(i))
+			}
+			name = format[i+2 : i+end]
+			i += end
+		} else {
+			j := i + 1
+			for j < len(format) && (isLower(format[j]) || format[j] >= '0' && format[j] <= '9' || format[j] == '_') {
+				j++
+			}
+			name = format[i+1 : j]
+			i = j - 1
+		}
+		if !validLogVariable(name) {
+			return nil, errors.New("unknown variable $" + name)
+		}
+		if literal.Len() > 0 {
+			tokens = append(tokens, LogToken{Literal: literal.String()})
+			literal.Reset()
+		}
+		tokens = append(tokens, LogToken{Var: name})
+	}
+	if literal.Len() > 0 {
+		tokens = append(tokens, LogToken{Literal: literal.String()})
+	}
+	return tokens, nil
+}
+
+func isLower(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+func validLogVariable(name string) bool {
+	if contains(logVariables, name) {
+		return true
+	}
+	for _, prefix := range logVariablePrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// validStatusPattern 判断状态码条件是否有效，可以是 404 或 4xx 形式
+func validStatusPattern(pattern string) bool {
+	if len(pattern) != 3 || pattern[0] < '1' || pattern[0] > '5' {
+		return false
+	}
+	if strings.ToLower(pattern[1:]) == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(pattern)
+	return err == nil
+}
+
+func (l *AccessLog) validate(prefix string, problems *Problems) {
+	if l.Format != "json" {
+		if _, err := ParseLogFormat(l.Format); err != nil {
+			problems.errorf(joinPath(prefix, "format"), "%v", err)
+		}
+	}
+	if l.Buffer < 0 {
+		problems.errorf(joinPath(prefix, "buffer"), "must not be negative")
+	}
+	if l.Flush < 0 {
+		problems.errorf(joinPath(prefix, "flush"), "must not be negative")
+	}
+	l.Rotate.validate(joinPath(prefix, "rotate"), l.Path, problems)
+	for i, c := range l.Skip {
+		skipPath := joinPath(prefix, "skip["+strconv.Itoa(i)+"]")
+		for j, pattern := range c.Status {
+			if !validStatusPattern(pattern) {
+				problems.errorf(joinPath(skipPath, "status["+strconv.Itoa(j)+"]"), "invalid status %q, expected a code like 404 or a class like 2xx", pattern)
+			}
+		}
+		for j, pattern := range c.Paths {
+			if !validGlob(pattern) {
+				problems.errorf(joinPath(skipPath, "paths["+strconv.Itoa(j)+"]"), "invalid pattern %q", pattern)
+			}
+		}
+		if _, err := netutil.ParseCIDRs(c.Clients); err != nil {
+			problems.errorf(joinPath(skipPath, "clients"), "%v", err)
+		}
+	}
+}
+
+// AccessLogFor 返回虚拟主机使用的访问日志配置，虚拟主机未配置 path 时使用全局配置
+func (conf *config) AccessLogFor(host *Vhost) *AccessLog {
+	if host != nil && host.AccessLog.Path != "" {
+		return &host.AccessLog
+	}
+	return &conf.AccessLog
+}
+
+// AccessLogs 返回所有启用的访问日志配置
+func (conf *config) AccessLogs() []*AccessLog {
+	logs := []*AccessLog{&conf.AccessLog, &conf.Default.AccessLog}
+	for i := range conf.Vhosts {
+		logs = append(logs, &conf.Vhosts[i].AccessLog)
+	}
+
+	enabled := logs[:0]
+	for _, l := range logs {
+		if !l.Disabled() {
+			enabled = append(enabled, l)
+		}
+	}
+	return enabled
+}
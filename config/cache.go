@@ -0,0 +1,47 @@
+package config
+
+import "strings"
+
+// Cache 存储 FastCGI 响应缓存的全局配置
+type Cache struct {
+	Path    string
+	MaxSize int64 `json:"max_size"`
+}
+
+type microcache struct {
+	Enable               bool
+	TTL                  int
+	Key                  []string
+	BypassCookies        []string `json:"bypass_cookies"`
+	StaleWhileRevalidate int      `json:"stale_while_revalidate"`
+	StaleIfError         int      `json:"stale_if_error"`
+}
+
+// defaultCacheKey 默认的缓存键
+var defaultCacheKey = []string{"scheme", "host", "uri"}
+
+func (mc *microcache) normalize() {
+	if mc.TTL == 0 {
+		mc.TTL = 10
+	}
+	if len(mc.Key) == 0 {
+		mc.Key = defaultCacheKey
+	}
+	if mc.BypassCookies == nil {
+		mc.BypassCookies = []string{"*"}
+	}
+}
+
+// validKeyPart 判断缓存键的组成部分是否有效
+func validKeyPart(part string) bool {
+	switch part {
+	case "scheme", "host", "uri", "path", "query", "method":
+		return true
+	}
+	for _, prefix := range []string{"header:", "cookie:"} {
+		if strings.HasPrefix(part, prefix) && len(part) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// defaultEncodings 默认启用的压缩算法，按优先级排列
+var defaultEncodings = []string{"br", "zstd", "gzip", "deflate"}
+
+// defaultCompressTypes 默认压缩的 MIME 类型
+var defaultCompressTypes = []string{
+	"text/*",
+	"application/javascript", "application/json", "application/manifest+json",
+	"application/xml", "application/rss+xml", "application/atom+xml", "application/wasm",
+	"image/svg+xml", "image/x-icon", "font/ttf", "font/otf",
+}
+
+// defaultMinSize 小于该长度的内容不压缩
+const defaultMinSize = 256
+
+// Encodings 支持的压缩算法
+var Encodings = []string{"br", "zstd", "gzip", "deflate"}
+
+type compression struct {
+	Disable       bool
+	Encodings     []string
+	Types         []string
+	MinSize       int `json:"min_size"`
+	Precompressed bool
+}
+
+func (c *compression) normalize() {
+	if len(c.Encodings) == 0 {
+		c.Encodings = defaultEncodings
+	}
+	if len(c.Types) == 0 {
+		c.Types = defaultCompressTypes
+	}
+	if c.MinSize == 0 {
+		c.MinSize = defaultMinSize
+	}
+}
+
+// Compressible 判断指定类型和长度的内容是否需要压缩
+func (c *compression) Compressible(contentType string, length int) bool {
+	if c.Disable || length < c.MinSize || contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.Types {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func validTypePattern(pattern string) bool {
+	return validGlob(pattern) && strings.Contains(pattern, "/")
+}
+
+func validGlob(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return err == nil
+}
@@ -3,9 +3,13 @@ package config
 import (
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
-	"github.com/kotoyuuko/bronya/logger"
+	"github.com/kotoyuuko/bronya/netutil"
 )
 
 type fastcgi struct {
@@ -13,50 +17,395 @@ type fastcgi struct {
 	Address string
 }
 
+type autoindex struct {
+	Enable bool
+	Format string
+	Hidden bool
+}
+
+type status struct {
+	Path     string
+	Allow    []string
+	Networks []*net.IPNet `json:"-"`
+}
+
+type proxy struct {
+	Enable  bool
+	Trusted []string
+	Timeout int
+}
+
+// Listener 存储监听器信息
+type Listener struct {
+	Name     string
+	Address  string
+	Port     string
+	Protocol string
+	Cert     string
+	Key      string
+	Socket   string
+	Mode     string
+	Proxy    proxy `json:"proxy_protocol"`
+}
+
 // Vhost 存储虚拟主机信息
 type Vhost struct {
-	Name    []string
-	Root    string
-	Index   []string
-	Fastcgi fastcgi
+	Name        []string
+	Root        string
+	Index       []string
+	Fastcgi     fastcgi
+	Listeners   []string
+	Htaccess    bool
+	Autoindex   autoindex
+	Symlinks    string
+	Deny        deny
+	Compression compression
+	FileCache   bool `json:"file_cache"`
+	Cache       microcache
+	AccessLog   AccessLog `json:"access_log"`
+	Status      status
+}
+
+// AssetCache 存储静态文件压缩缓存的配置
+type AssetCache struct {
+	Disable      bool
+	MaxSize      int64 `json:"max_size"`
+	MaxEntrySize int64 `json:"max_entry_size"`
+}
+
+// FileCache 存储路径解析与打开文件缓存的配置
+type FileCache struct {
+	MaxEntries int `json:"max_entries"`
+	MaxOpen    int `json:"max_open"`
+	TTL        int
+}
+
+// Log 存储服务器日志的配置
+type Log struct {
+	Level   string
+	Format  string
+	Outputs []LogOutput
+}
+
+// LogOutput 存储日志输出的配置，Level 和 Format 为空时使用 Log 中的设置
+type LogOutput struct {
+	Path   string
+	Level  string
+	Format string
+	Rotate Rotate
+}
+
+// Rotate 存储日志文件轮转的配置
+type Rotate struct {
+	MaxSize  int64 `json:"max_size"`
+	Interval string
+	Keep     int
+	Compress bool
+}
+
+// Admin 存储管理接口的配置，指定监听器上的请求由管理接口处理
+type Admin struct {
+	Listener string
+	Token    string
+}
+
+// Metrics 存储 Prometheus 指标接口的配置，指定监听器上请求 Path 时输出指标
+type Metrics struct {
+	Listener string
+	Path     string
+	Allow    []string
+	Networks []*net.IPNet `json:"-"`
+}
+
+// RealIP 存储通过代理头部还原客户端地址的配置
+type RealIP struct {
+	Header   string
+	Trusted  []string
+	Networks []*net.IPNet `json:"-"`
 }
 
 type config struct {
-	Listen  string
-	Port    string
-	Vhosts  []Vhost
-	Default Vhost
+	Include          []string
+	Listen           string
+	Port             string
+	Pid              string
+	ErrorLog         string `json:"error_log"`
+	Log              Log
+	AccessLog        AccessLog `json:"access_log"`
+	Listeners        []Listener
+	RealIP           RealIP     `json:"real_ip"`
+	AssetCache       AssetCache `json:"asset_cache"`
+	FileCache        FileCache  `json:"file_cache"`
+	Cache            Cache
+	Admin            Admin
+	Metrics          Metrics
+	KeepAliveTimeout int   `json:"keepalive_timeout"`
+	ShutdownTimeout  int   `json:"shutdown_timeout"`
+	MaxBodySize      int64 `json:"max_body_size"`
+	Vhosts           []Vhost
+	Default          Vhost
+
+	implicitListener bool
 }
 
-// Config 存储从配置文件中读取并解析后的配置
-var Config *config
+// Path 配置文件路径
+var Path = "config.json"
 
-func init() {
-	logger.Info.Println("Parsing config file...")
+var (
+	current    atomic.Value
+	generation uint64
+)
+
+// Current 返回当前生效的配置快照，快照在替换后不会再被修改
+func Current() *config {
+	conf, _ := current.Load().(*config)
+	return conf
+}
 
-	configJSON, err := ioutil.ReadFile("config.json")
+// Generation 返回当前配置的版本号，每次成功加载后递增
+func Generation() uint64 {
+	return atomic.LoadUint64(&generation)
+}
+
+// Reload 重新读取并校验 Path 指向的配置文件，成功后原子替换当前配置，失败时保留原配置。
+// 返回的 Problems 为不影响加载的警告
+func Reload() (Problems, error) {
+	conf, problems, err := Load(Path)
 	if err != nil {
-		logger.Error.Fatalln(err)
+		return problems, err
 	}
+	Store(conf)
+	return problems, nil
+}
 
-	Config = &config{}
-	err = json.Unmarshal(configJSON, Config)
+// Store 原子替换当前配置并递增版本号，conf 必须是 Load 返回的配置
+func Store(conf *config) {
+	current.Store(conf)
+	atomic.AddUint64(&generation, 1)
+}
+
+// Load 读取、解析并校验配置文件，支持 JSON、YAML 与 TOML 格式，
+// 存在错误时返回的 error 为 Problems
+func Load(path string) (*config, Problems, error) {
+	configJSON, err := readConfig(path)
 	if err != nil {
-		logger.Error.Fatalln(err)
+		return nil, nil, err
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(configJSON, &raw); err != nil {
+		return nil, nil, err
+	}
+
+	// 先对照配置结构检查整棵树，一次报告所有未知的键与类型错误
+	conf := &config{}
+	var problems Problems
+	checkKeys("", raw, reflect.TypeOf(conf).Elem(), &problems)
+
+	err = json.Unmarshal(configJSON, conf)
+	if err != nil {
+		e, ok := err.(*json.UnmarshalTypeError)
+		if !ok {
+			return nil, nil, err
+		}
+		if !problems.HasErrors() {
+			problems.errorf(e.Field, "expected %s, got %s", e.Type, e.Value)
+		}
+		// 类型错误的字段保持零值，继续校验只会产生误导性的错误
+		return nil, problems, problems.Errors()
+	}
+
+	conf.normalize()
+	conf.validate(&problems)
+
+	if problems.HasErrors() {
+		return nil, problems, problems.Errors()
+	}
+	return conf, problems, nil
+}
+
+// Decode 读取并解析配置文件但不做校验，供只需要 pid 文件、管理监听器等少数字段的控制命令使用，
+// 避免检查网站根目录或连接 FastCGI
+func Decode(path string) (*config, error) {
+	configJSON, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &config{}
+	if err := json.Unmarshal(configJSON, conf); err != nil {
+		return nil, err
 	}
+	conf.normalize()
+	return conf, nil
+}
+
+// normalize 填充默认值并预处理配置
+func (conf *config) normalize() {
+	if conf.Pid == "" {
+		conf.Pid = "bronya.pid"
+	}
+	if conf.ErrorLog == "" {
+		conf.ErrorLog = "errors.log"
+	}
+	if conf.Log.Level == "" {
+		conf.Log.Level = "info"
+	}
+	if conf.Log.Format == "" {
+		conf.Log.Format = "text"
+	}
+	if len(conf.Log.Outputs) == 0 {
+		conf.Log.Outputs = []LogOutput{{Path: "stderr"}, {Path: conf.ErrorLog, Level: "error"}}
+	}
+	if conf.AccessLog.Path == "" {
+		conf.AccessLog.Path = "access.log"
+	}
+	conf.AccessLog.normalize()
+	if conf.KeepAliveTimeout == 0 {
+		conf.KeepAliveTimeout = 60
+	}
+	if conf.ShutdownTimeout == 0 {
+		conf.ShutdownTimeout = 30
+	}
+	if conf.MaxBodySize == 0 {
+		conf.MaxBodySize = 8 << 20
+	}
+	if conf.AssetCache.MaxSize == 0 {
+		conf.AssetCache.MaxSize = 32 << 20
+	}
+	if conf.AssetCache.MaxEntrySize == 0 {
+		conf.AssetCache.MaxEntrySize = 1 << 20
+	}
+	if conf.FileCache.MaxEntries == 0 {
+		conf.FileCache.MaxEntries = 10000
+	}
+	if conf.FileCache.MaxOpen == 0 {
+		conf.FileCache.MaxOpen = 1000
+	}
+	if conf.FileCache.TTL == 0 {
+		conf.FileCache.TTL = 10
+	}
+	if conf.Cache.Path == "" {
+		conf.Cache.Path = "cache"
+	}
+	if conf.Cache.MaxSize == 0 {
+		conf.Cache.MaxSize = 256 << 20
+	}
+
+	if len(conf.Listeners) == 0 {
+		conf.implicitListener = true
+		conf.Listeners = append(conf.Listeners, Listener{
+			Name:    "default",
+			Address: conf.Listen,
+			Port:    conf.Port,
+		})
+	}
+	for i := range conf.Listeners {
+		ln := &conf.Listeners[i]
+		if ln.Protocol == "" {
+			ln.Protocol = "plain"
+		}
+		if ln.Name == "" {
+			ln.Name = ln.Network() + "://" + ln.Addr()
+		}
+	}
+
+	conf.RealIP.Networks, _ = netutil.ParseCIDRs(conf.RealIP.Trusted)
+	if conf.Metrics.Path == "" {
+		conf.Metrics.Path = "/metrics"
+	}
+	conf.Metrics.Networks, _ = netutil.ParseCIDRs(conf.Metrics.Allow)
 
-	logger.Info.Println("Config file parsed.")
+	for i := range conf.Vhosts {
+		conf.Vhosts[i].Deny.compile()
+		conf.Vhosts[i].Compression.normalize()
+		conf.Vhosts[i].Cache.normalize()
+		conf.Vhosts[i].AccessLog.normalize()
+		conf.Vhosts[i].Status.Networks, _ = netutil.ParseCIDRs(conf.Vhosts[i].Status.Allow)
+	}
+	conf.Default.Deny.compile()
+	conf.Default.Compression.normalize()
+	conf.Default.Cache.normalize()
+	conf.Default.AccessLog.normalize()
+	conf.Default.Status.Networks, _ = netutil.ParseCIDRs(conf.Default.Status.Allow)
+}
+
+// Network 返回监听器使用的网络类型
+func (ln *Listener) Network() string {
+	if ln.Socket != "" {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// Addr 返回监听器的监听地址
+func (ln *Listener) Addr() string {
+	if ln.Socket != "" {
+		return ln.Socket
+	}
+	return ln.Address + ":" + ln.Port
 }
 
-// SearchVhost 按照指定的域名查找虚拟主机
-func SearchVhost(searchName string) (*Vhost, error) {
-	for _, host := range Config.Vhosts {
+// TLS 判断监听器是否使用 TLS
+func (ln *Listener) TLS() bool {
+	return ln.Protocol == "tls"
+}
+
+// Accepts 判断虚拟主机是否接受来自指定监听器的请求
+func (host *Vhost) Accepts(listener string) bool {
+	if len(host.Listeners) == 0 {
+		return true
+	}
+	for _, name := range host.Listeners {
+		if name == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// Identity 返回监听器的唯一标识，标识相同的监听器在重新加载配置时会被保留
+func (ln *Listener) Identity() string {
+	return strings.Join([]string{
+		ln.Network(), ln.Addr(), ln.Protocol, ln.Cert, ln.Key, ln.Mode,
+		strconv.FormatBool(ln.Proxy.Enable), strings.Join(ln.Proxy.Trusted, ","), strconv.Itoa(ln.Proxy.Timeout),
+	}, "|")
+}
+
+// AdminListener 返回管理接口使用的监听器，未配置时返回 nil
+func (conf *config) AdminListener() *Listener {
+	return conf.listener(conf.Admin.Listener)
+}
+
+// listener 按名称查找监听器，名称为空或者不存在时返回 nil
+func (conf *config) listener(name string) *Listener {
+	if name == "" {
+		return nil
+	}
+	for i := range conf.Listeners {
+		if conf.Listeners[i].Name == name {
+			return &conf.Listeners[i]
+		}
+	}
+	return nil
+}
+
+// SearchVhost 按照指定的域名及监听器查找虚拟主机
+func (conf *config) SearchVhost(searchName string, listener string) (*Vhost, error) {
+	for i := range conf.Vhosts {
+		host := &conf.Vhosts[i]
+		if !host.Accepts(listener) {
+			continue
+		}
 		for _, name := range host.Name {
 			if name == searchName {
-				return &host, nil
+				return host, nil
 			}
 		}
 	}
 
-	return &Config.Default, errors.New("Vhost not found")
+	if !conf.Default.Accepts(listener) {
+		return nil, errors.New("Vhost not found")
+	}
+	return &conf.Default, errors.New("Vhost not found")
 }
@@ -0,0 +1,298 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// baseConfig 是一份能通过校验的最小配置，ROOT 会被替换为临时目录
+const baseConfig = `{
+	"listeners": [{"name": "public", "address": "127.0.0.1", "port": "8080"}],
+	"vhosts": [{"name": ["a.test"], "root": "ROOT", "index": ["index.html"]}],
+	"default": {"root": "ROOT", "index": ["index.html"]}
+}`
+
+// writeFile 在 dir 下写入文件，内容中的 ROOT 替换为 dir
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root, _ := json.Marshal(dir)
+	content = strings.Replace(content, `"ROOT"`, string(root), -1)
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// patchConfig 用 patch 中的顶层键覆盖 baseConfig
+func patchConfig(t *testing.T, patch string) string {
+	t.Helper()
+	var base, override map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(baseConfig), &base); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(patch), &override); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range override {
+		base[key] = value
+	}
+	content, err := json.Marshal(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestLoadValid(t *testing.T) {
+	dir := t.TempDir()
+	conf, problems, err := Load(writeFile(t, dir, "config.json", baseConfig))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("problems = %v, want none", problems)
+	}
+	if len(conf.Vhosts) != 1 || conf.Vhosts[0].Root != dir {
+		t.Errorf("vhosts = %+v", conf.Vhosts)
+	}
+}
+
+func TestLoadProblems(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		want  []Problem
+	}{
+		{
+			name:  "unknown key",
+			patch: `{"listner": []}`,
+			want:  []Problem{{Path: "listner", Message: "unknown key"}},
+		},
+		{
+			name:  "unknown key with suggestion",
+			patch: `{"keepAliveTimeout": 60, "Pid": "x.pid"}`,
+			want: []Problem{
+				{Path: "Pid", Message: `unknown key, did you mean "pid"?`},
+				{Path: "keepAliveTimeout", Message: `unknown key, did you mean "keepalive_timeout"?`},
+			},
+		},
+		{
+			name:  "nested unknown key",
+			patch: `{"vhosts": [{"name": ["a.test"], "root": "ROOT", "index": ["index.html"], "fastcgi": {"network": "tcp", "adress": "127.0.0.1:9000"}}]}`,
+			want: []Problem{
+				{Path: "vhosts[0].fastcgi.adress", Message: "unknown key"},
+				{Path: "vhosts[0].fastcgi.address", Message: "required"},
+			},
+		},
+		{
+			name:  "type errors",
+			patch: `{"keepalive_timeout": "60", "shutdown_timeout": 1.5, "max_body_size": -1.5, "vhosts": [{"name": "a.test", "root": "ROOT", "htaccess": 1}]}`,
+			want: []Problem{
+				{Path: "keepalive_timeout", Message: "expected integer, got string"},
+				{Path: "max_body_size", Message: "expected integer, got number -1.5"},
+				{Path: "shutdown_timeout", Message: "expected integer, got number 1.5"},
+				{Path: "vhosts[0].htaccess", Message: "expected boolean, got number 1"},
+				{Path: "vhosts[0].name", Message: "expected array, got string"},
+			},
+		},
+		{
+			name:  "type error in array",
+			patch: `{"listeners": [{"name": "public", "address": "127.0.0.1", "port": 8080}]}`,
+			want:  []Problem{{Path: "listeners[0].port", Message: "expected string, got number 8080"}},
+		},
+		{
+			name:  "cidr errors",
+			patch: `{"real_ip": {"trusted": ["10.0.0.0/33"]}, "metrics": {"listener": "public", "allow": ["localhost"]}}`,
+			want: []Problem{
+				{Path: "metrics.allow", Message: `invalid IP address "localhost"`},
+				{Path: "real_ip.trusted", Message: "invalid CIDR address: 10.0.0.0/33"},
+			},
+		},
+		{
+			name:  "vhost cidr error",
+			patch: `{"vhosts": [{"name": ["a.test"], "root": "ROOT", "index": ["index.html"], "status": {"path": "/status", "allow": ["192.0.2.1/24", "::1/129"]}}]}`,
+			want:  []Problem{{Path: "vhosts[0].status.allow", Message: "invalid CIDR address: ::1/129"}},
+		},
+		{
+			name: "duplicate vhosts",
+			patch: `{"vhosts": [
+				{"name": ["a.test", "www.a.test"], "root": "ROOT", "index": ["index.html"]},
+				{"name": ["b.test", "A.TEST"], "root": "ROOT", "index": ["index.html"]}
+			]}`,
+			want: []Problem{{Path: "vhosts[1].name[1]", Message: `duplicate vhost name "A.TEST", already used by vhosts[0].name[0]`}},
+		},
+		{
+			name: "duplicate listeners",
+			patch: `{"listeners": [
+				{"name": "public", "address": "127.0.0.1", "port": "8080"},
+				{"name": "public", "address": "127.0.0.1", "port": "8080"}
+			]}`,
+			want: []Problem{
+				{Path: "listeners[1]", Message: "address tcp://127.0.0.1:8080 already used by listeners[0]"},
+				{Path: "listeners[1].name", Message: `duplicate listener name "public", already used by listeners[0]`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, problems, err := Load(writeFile(t, t.TempDir(), "config.json", patchConfig(t, tt.patch)))
+			if err == nil || conf != nil {
+				t.Fatalf("Load = %v, %v, want an error", conf, err)
+			}
+			got := make(map[Problem]bool)
+			for _, p := range problems.Errors() {
+				got[p] = true
+			}
+			for _, p := range tt.want {
+				if !got[p] {
+					t.Errorf("missing %s", p)
+				}
+				delete(got, p)
+			}
+			for p := range got {
+				t.Errorf("unexpected %s", p)
+			}
+		})
+	}
+}
+
+func TestLoadInclude(t *testing.T) {
+	dir := t.TempDir()
+	main := writeFile(t, dir, "config.json", `{
+		"include": ["conf.d/*.json", "extra.yaml"],
+		"listeners": [{"name": "public", "address": "127.0.0.1", "port": "8080"}],
+		"real_ip": {"header": "X-Real-IP"},
+		"vhosts": [{"name": ["a.test"], "root": "ROOT", "index": ["index.html"]}],
+		"default": {"root": "ROOT", "index": ["index.html"]}
+	}`)
+	writeFile(t, dir, "conf.d/b.json", `{"vhosts": [{"name": ["b.test"], "root": "ROOT", "index": ["index.html"]}]}`)
+	writeFile(t, dir, "conf.d/c.json", `{"vhosts": [{"name": ["c.test"], "root": "ROOT", "index": ["index.html"]}], "real_ip": {"header": "X-Real-IP", "trusted": ["10.0.0.0/8"]}}`)
+	writeFile(t, dir, "conf.d/ignored.txt", `not json`)
+	writeFile(t, dir, "extra.yaml", "listeners:\n  - name: internal\n    address: 127.0.0.1\n    port: \"8081\"\nkeepalive_timeout: 30\n")
+
+	conf, problems, err := Load(main)
+	if err != nil {
+		t.Fatalf("Load: %v\n%v", err, problems)
+	}
+	var names []string
+	for _, host := range conf.Vhosts {
+		names = append(names, host.Name...)
+	}
+	if got := strings.Join(names, ","); got != "a.test,b.test,c.test" {
+		t.Errorf("vhosts = %s, want a.test,b.test,c.test in include order", got)
+	}
+	if len(conf.Listeners) != 2 || conf.Listeners[1].Name != "internal" {
+		t.Errorf("listeners = %+v, want public and internal", conf.Listeners)
+	}
+	if conf.RealIP.Header != "X-Real-IP" || len(conf.RealIP.Trusted) != 1 {
+		t.Errorf("real_ip = %+v, want the merged object", conf.RealIP)
+	}
+	if conf.KeepAliveTimeout != 30 {
+		t.Errorf("keepalive_timeout = %d, want 30", conf.KeepAliveTimeout)
+	}
+}
+
+func TestLoadIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name: "conflicting value",
+			files: map[string]string{
+				"config.json": `{"include": "a.json", "keepalive_timeout": 60}`,
+				"a.json":      `{"keepalive_timeout": 30}`,
+			},
+			want: "a.json: keepalive_timeout: conflicts with a value set in another file",
+		},
+		{
+			name: "conflicting nested value",
+			files: map[string]string{
+				"config.json": `{"include": "a.json", "real_ip": {"header": "X-Real-IP"}}`,
+				"a.json":      `{"real_ip": {"header": "Forwarded"}}`,
+			},
+			want: "a.json: real_ip.header: conflicts with a value set in another file",
+		},
+		{
+			name: "object and array",
+			files: map[string]string{
+				"config.json": `{"include": "a.json", "vhosts": []}`,
+				"a.json":      `{"vhosts": {"name": ["a.test"]}}`,
+			},
+			want: "a.json: vhosts: conflicts with a value set in another file",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"config.json": `{"include": "a.json"}`,
+				"a.json":      `{"include": "config.json"}`,
+			},
+			want: "config.json: include cycle",
+		},
+		{
+			name: "bad include",
+			files: map[string]string{
+				"config.json": `{"include": [1]}`,
+			},
+			want: "config.json: include: expected a list of glob patterns",
+		},
+		{
+			name: "syntax error in included file",
+			files: map[string]string{
+				"config.json": `{"include": "a.json"}`,
+				"a.json":      `{"pid": }`,
+			},
+			want: "a.json: invalid character '}' looking for beginning of value",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.files {
+				writeFile(t, dir, name, content)
+			}
+			_, _, err := Load(filepath.Join(dir, "config.json"))
+			if err == nil || !strings.HasSuffix(err.Error(), tt.want) {
+				t.Errorf("Load error = %v, want suffix %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadInterpolate(t *testing.T) {
+	t.Setenv("BRONYA_TEST_ADDRESS", "127.0.0.2")
+	t.Setenv("BRONYA_TEST_EMPTY", "")
+	os.Unsetenv("BRONYA_TEST_MISSING")
+
+	dir := t.TempDir()
+	conf, problems, err := Load(writeFile(t, dir, "config.json", patchConfig(t, `{
+		"listeners": [{"name": "public", "address": "${BRONYA_TEST_ADDRESS:-0.0.0.0}", "port": "${BRONYA_TEST_MISSING:-8080}"}],
+		"admin": {"token": "$${BRONYA_TEST_ADDRESS}${BRONYA_TEST_EMPTY:-unused}"}
+	}`)))
+	if err != nil {
+		t.Fatalf("Load: %v\n%v", err, problems)
+	}
+	ln := conf.Listeners[0]
+	if ln.Address != "127.0.0.2" || ln.Port != "8080" {
+		t.Errorf("listener = %s:%s, want 127.0.0.2:8080", ln.Address, ln.Port)
+	}
+	// $$ 转义为 $，设置为空字符串的变量不使用默认值
+	if conf.Admin.Token != "${BRONYA_TEST_ADDRESS}" {
+		t.Errorf("admin.token = %q, want ${BRONYA_TEST_ADDRESS}", conf.Admin.Token)
+	}
+
+	_, _, err = Load(writeFile(t, dir, "missing.json", patchConfig(t, `{
+		"listeners": [{"name": "public", "address": "127.0.0.1", "port": "${BRONYA_TEST_MISSING}"}]
+	}`)))
+	if want := "listeners[0].port: environment variable BRONYA_TEST_MISSING is not set"; err == nil || err.Error() != want {
+		t.Errorf("Load error = %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// defaultDeny 默认拒绝访问的文件：隐藏文件与 VCS 目录、备份文件、数据库导出以及依赖清单
+var defaultDeny = []string{
+	".*", "!.well-known",
+	"CVS", "*~", "*.bak", "*.old", "*.orig", "*.save", "*.swp", "*.swo",
+	"*.sql", "*.sqlite",
+	"composer.json", "composer.lock", "package.json", "package-lock.json", "yarn.lock",
+}
+
+// phpExtensions 会被当作 PHP 源码的扩展名
+var phpExtensions = []string{".php", ".phtml", ".php3", ".php4", ".php5", ".php7", ".php8", ".phps", ".phar", ".inc"}
+
+type deny struct {
+	Patterns       []string
+	Status         int
+	NoDefaults     bool        `json:"no_defaults"`
+	AllowPHPSource bool        `json:"allow_php_source"`
+	Rules          []*DenyRule `json:"-"`
+}
+
+// DenyRule 存储一条拒绝访问规则
+type DenyRule struct {
+	Pattern string
+	negate  bool
+	glob    string
+	regexp  *regexp.Regexp
+}
+
+// ParseDenyRule 解析拒绝访问规则：以 ~ 开头的为正则表达式，否则为通配符，
+// 不含 / 的通配符匹配路径中的任意一段，以 ! 开头表示例外。匹配时不区分大小写
+func ParseDenyRule(pattern string) (*DenyRule, error) {
+	rule := &DenyRule{Pattern: pattern}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	if pattern == "" || pattern == "~" {
+		return nil, errors.New("empty pattern")
+	}
+
+	if strings.HasPrefix(pattern, "~") {
+		re, err := regexp.Compile("(?i)" + pattern[1:])
+		if err != nil {
+			return nil, err
+		}
+		rule.regexp = re
+		return rule, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	rule.glob = strings.ToLower(pattern)
+	return rule, nil
+}
+
+// Match 判断规则是否匹配请求路径
+func (rule *DenyRule) Match(p string) bool {
+	if rule.regexp != nil {
+		return rule.regexp.MatchString(p)
+	}
+	p = strings.ToLower(p)
+	if strings.Contains(rule.glob, "/") {
+		ok, _ := path.Match("/"+strings.TrimPrefix(rule.glob, "/"), strings.TrimSuffix(p, "/"))
+		return ok
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "" {
+			continue
+		}
+		if ok, _ := path.Match(rule.glob, segment); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchLast 判断规则是否匹配路径的最后一级：不含 / 的通配符只匹配最后一段，
+// 其他规则匹配整个路径
+func (rule *DenyRule) matchLast(p string) bool {
+	if rule.regexp != nil || strings.Contains(rule.glob, "/") {
+		return rule.Match(p)
+	}
+	ok, _ := path.Match(rule.glob, strings.ToLower(path.Base(p)))
+	return ok
+}
+
+func (d *deny) patterns() []string {
+	if d.NoDefaults {
+		return d.Patterns
+	}
+	return append(append([]string{}, defaultDeny...), d.Patterns...)
+}
+
+func (d *deny) compile() {
+	d.Rules = nil
+	for _, pattern := range d.patterns() {
+		if rule, err := ParseDenyRule(pattern); err == nil {
+			d.Rules = append(d.Rules, rule)
+		}
+	}
+	if d.Status == 0 {
+		d.Status = 403
+	}
+}
+
+// Denied 判断请求路径是否被拒绝。路径从根目录开始逐级检查，每一级按顺序匹配所有规则，
+// 以最后一条匹配的规则为准，任意一级被拒绝则整个路径被拒绝。
+// 因此 !.well-known 只放行 .well-known 目录本身，其中的 .env 仍会被 .* 拒绝
+func (d *deny) Denied(p string) bool {
+	current := ""
+	for _, segment := range strings.Split(strings.Trim(p, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		current += "/" + segment
+		denied := false
+		for _, rule := range d.Rules {
+			if rule.matchLast(current) {
+				denied = !rule.negate
+			}
+		}
+		if denied {
+			return true
+		}
+	}
+	return false
+}
+
+// PHPSource 判断文件是否为不会交给 FastCGI 执行的 PHP 源码，
+// 开启 allow_php_source 时总是返回 false
+func (host *Vhost) PHPSource(file string) bool {
+	if host.Deny.AllowPHPSource {
+		return false
+	}
+	if strings.HasSuffix(file, ".php") && host.Fastcgi.Address != "" {
+		return false
+	}
+	ext := strings.ToLower(path.Ext(file))
+	for _, php := range phpExtensions {
+		if ext == php {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package config
+
+import "testing"
+
+func TestDenied(t *testing.T) {
+	tests := []struct {
+		patterns   []string
+		noDefaults bool
+		path       string
+		denied     bool
+	}{
+		{path: "/index.html"},
+		{path: "/.env", denied: true},
+		{path: "/.git/config", denied: true},
+		{path: "/.well-known/acme-challenge/token"},
+		{path: "/.well-known/.env", denied: true},
+		{path: "/.well-known/.git/HEAD", denied: true},
+		{path: "/composer.json", denied: true},
+		{path: "/Composer.JSON", denied: true},
+		{path: "/X.BAK", denied: true},
+		{path: "/sub/dump.SQL", denied: true},
+		{path: "/CVS/Entries", denied: true},
+		{path: "/cvs/Entries", denied: true},
+
+		{patterns: []string{"/private/*"}, noDefaults: true, path: "/private/a.txt", denied: true},
+		{patterns: []string{"/private/*"}, noDefaults: true, path: "/private/a/b.txt", denied: true},
+		{patterns: []string{"/private/*"}, noDefaults: true, path: "/PRIVATE/a.txt", denied: true},
+		{patterns: []string{"/private/*"}, noDefaults: true, path: "/public/private.txt"},
+		{patterns: []string{`~\.key$`}, noDefaults: true, path: "/ssl/site.KEY", denied: true},
+		{patterns: []string{`~\.key$`}, noDefaults: true, path: "/ssl/site.key.txt"},
+
+		// 以最后一条匹配的规则为准
+		{patterns: []string{"*.txt", "!robots.txt"}, noDefaults: true, path: "/robots.txt"},
+		{patterns: []string{"*.txt", "!robots.txt"}, noDefaults: true, path: "/notes.txt", denied: true},
+		{patterns: []string{"!robots.txt", "*.txt"}, noDefaults: true, path: "/robots.txt", denied: true},
+		{patterns: []string{"!.env.example"}, path: "/.env.example"},
+		{patterns: []string{"!.env.example"}, path: "/.env", denied: true},
+		// 例外只作用于匹配的那一级，不会放行被拒绝的上级目录
+		{patterns: []string{"!robots.txt"}, path: "/.git/robots.txt", denied: true},
+	}
+	for _, tt := range tests {
+		d := &deny{Patterns: tt.patterns, NoDefaults: tt.noDefaults}
+		d.compile()
+		if got := d.Denied(tt.path); got != tt.denied {
+			t.Errorf("patterns=%q no_defaults=%v: Denied(%q) = %v, want %v", tt.patterns, tt.noDefaults, tt.path, got, tt.denied)
+		}
+	}
+}
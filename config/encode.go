@@ -0,0 +1,74 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Encode 按指定格式（json、yaml 或 toml）输出配置，省略未设置的字段
+func (conf *config) Encode(format string) ([]byte, error) {
+	tree := encodeValue(reflect.ValueOf(conf).Elem())
+	if tree == nil {
+		tree = map[string]interface{}{}
+	}
+
+	switch format {
+	case "yaml", "yml":
+		return yaml.Marshal(tree)
+	case "toml":
+		t, err := toml.TreeFromMap(tree.(map[string]interface{}))
+		if err != nil {
+			return nil, err
+		}
+		return t.Marshal()
+	default:
+		content, err := json.MarshalIndent(tree, "", "    ")
+		if err != nil {
+			return nil, err
+		}
+		return append(content, '\n'), nil
+	}
+}
+
+// encodeValue 将配置结构转换为以配置文件键名为键的通用结构，零值返回 nil
+func encodeValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+				continue
+			}
+			if value := encodeValue(v.Field(i)); value != nil {
+				m[jsonKey(f)] = value
+			}
+		}
+		if len(m) == 0 {
+			return nil
+		}
+		return m
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
+		}
+		list := make([]interface{}, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			list[i] = encodeValue(v.Index(i))
+			if list[i] == nil && v.Index(i).Kind() == reflect.Struct {
+				list[i] = map[string]interface{}{}
+			} else if list[i] == nil {
+				list[i] = v.Index(i).Interface()
+			}
+		}
+		return list
+	}
+	if v.IsZero() {
+		return nil
+	}
+	return v.Interface()
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envPattern 匹配 ${NAME} 与 ${NAME:-default} 形式的环境变量引用
+var envPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// readConfig 读取配置文件及其包含的文件，合并并替换环境变量后转换为 JSON
+func readConfig(path string) ([]byte, error) {
+	tree, err := readTree(path, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := interpolate(tree, "")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// readTree 按扩展名解析配置文件，并将 include 指定的文件依次合并进来
+func readTree(path string, seen map[string]bool) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if seen[abs] {
+		return nil, fmt.Errorf("%s: include cycle", path)
+	}
+	seen[abs] = true
+	defer delete(seen, abs)
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := decode(path, content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	tree, ok := normalizeValue(value).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: top level must be an object", path)
+	}
+
+	includes, err := includePatterns(tree["include"])
+	if err != nil {
+		return nil, fmt.Errorf("%s: include: %v", path, err)
+	}
+	delete(tree, "include")
+
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: include %q: %v", path, pattern, err)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			sub, err := readTree(match, seen)
+			if err != nil {
+				return nil, err
+			}
+			if err := merge(tree, sub, ""); err != nil {
+				return nil, fmt.Errorf("%s: %v", match, err)
+			}
+		}
+	}
+	return tree, nil
+}
+
+// decode 根据扩展名选择 JSON、YAML 或 TOML 解析器
+func decode(path string, content []byte) (interface{}, error) {
+	var value interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err := yaml.Unmarshal(content, &value)
+		return value, err
+	case ".toml":
+		tree, err := toml.LoadBytes(content)
+		if err != nil {
+			return nil, err
+		}
+		return tree.ToMap(), nil
+	default:
+		err := json.Unmarshal(content, &value)
+		return value, err
+	}
+}
+
+// normalizeValue 将 YAML 解析出的 map[interface{}]interface{} 统一转换为 map[string]interface{}
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = normalizeValue(val)
+		}
+		return m
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = normalizeValue(val)
+		}
+		return v
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalizeValue(val)
+		}
+		return v
+	}
+	return value
+}
+
+func includePatterns(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		patterns := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a list of glob patterns")
+			}
+			patterns = append(patterns, s)
+		}
+		return patterns, nil
+	}
+	return nil, fmt.Errorf("expected a glob pattern or a list of glob patterns")
+}
+
+// merge 将被包含的配置合并到 dst 中：对象递归合并，数组追加，
+// 同一个键在两个文件中出现不同的值视为冲突
+func merge(dst, src map[string]interface{}, path string) error {
+	for key, value := range src {
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = value
+			continue
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if d, ok := existing.(map[string]interface{}); ok {
+				if err := merge(d, v, joinPath(path, key)); err != nil {
+					return err
+				}
+				continue
+			}
+		case []interface{}:
+			if d, ok := existing.([]interface{}); ok {
+				dst[key] = append(d, v...)
+				continue
+			}
+		default:
+			if fmt.Sprint(existing) == fmt.Sprint(value) {
+				continue
+			}
+		}
+		return fmt.Errorf("%s: conflicts with a value set in another file", joinPath(path, key))
+	}
+	return nil
+}
+
+// interpolate 替换所有字符串值中的环境变量引用，$$ 表示字面量 $
+func interpolate(value interface{}, path string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		var err error
+		result := envPattern.ReplaceAllStringFunc(v, func(ref string) string {
+			if ref == "$$" {
+				return "$"
+			}
+			m := envPattern.FindStringSubmatch(ref)
+			if env, ok := os.LookupEnv(m[1]); ok {
+				return env
+			}
+			if m[2] != "" {
+				return m[3]
+			}
+			if err == nil {
+				err = fmt.Errorf("%s: environment variable %s is not set", path, m[1])
+			}
+			return ""
+		})
+		return result, err
+	case map[string]interface{}:
+		for key, val := range v {
+			res, err := interpolate(val, joinPath(path, key))
+			if err != nil {
+				return nil, err
+			}
+			v[key] = res
+		}
+	case []interface{}:
+		for i, val := range v {
+			res, err := interpolate(val, path+"["+strconv.Itoa(i)+"]")
+			if err != nil {
+				return nil, err
+			}
+			v[i] = res
+		}
+	}
+	return value, nil
+}
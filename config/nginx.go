@@ -0,0 +1,483 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// nginxDirective 存储 nginx 配置中的一条指令
+type nginxDirective struct {
+	Name  string
+	Args  []string
+	Block []*nginxDirective
+	File  string
+	Line  int
+}
+
+func (d *nginxDirective) String() string {
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, strings.TrimSpace(d.Name+" "+strings.Join(d.Args, " ")))
+}
+
+type nginxToken struct {
+	text   string
+	line   int
+	quoted bool
+}
+
+// tokenizeNginx 将 nginx 配置拆分为单词、引号字符串以及 { } ; 符号
+func tokenizeNginx(content string) ([]nginxToken, error) {
+	var tokens []nginxToken
+	line := 1
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, nginxToken{text: string(c), line: line})
+			i++
+		case c == '"' || c == '\'':
+			start := line
+			var sb strings.Builder
+			i++
+			for ; i < len(content) && content[i] != c; i++ {
+				if content[i] == '\\' && i+1 < len(content) {
+					i++
+				}
+				if content[i] == '\n' {
+					line++
+				}
+				sb.WriteByte(content[i])
+			}
+			if i >= len(content) {
+				return nil, fmt.Errorf("line %d: unterminated string", start)
+			}
+			i++
+			tokens = append(tokens, nginxToken{text: sb.String(), line: start, quoted: true})
+		default:
+			start := i
+			for i < len(content) && !strings.ContainsRune(" \t\r\n{};\"'", rune(content[i])) {
+				if content[i] == '\\' && i+1 < len(content) {
+					i++
+				}
+				i++
+			}
+			tokens = append(tokens, nginxToken{text: content[start:i], line: line})
+		}
+	}
+	return tokens, nil
+}
+
+// parseNginx 解析 nginx 配置文件，include 指令会被展开
+func parseNginx(path string, seen map[string]bool) ([]*nginxDirective, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if seen[abs] {
+		return nil, fmt.Errorf("%s: include cycle", path)
+	}
+	seen[abs] = true
+	defer delete(seen, abs)
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := tokenizeNginx(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	p := &nginxParser{path: path, tokens: tokens, seen: seen}
+	directives, err := p.block(false)
+	if err != nil {
+		return nil, err
+	}
+	return directives, nil
+}
+
+type nginxParser struct {
+	path   string
+	tokens []nginxToken
+	pos    int
+	seen   map[string]bool
+}
+
+func (p *nginxParser) block(nested bool) ([]*nginxDirective, error) {
+	var directives []*nginxDirective
+	for p.pos < len(p.tokens) {
+		tok := p.tokens[p.pos]
+		p.pos++
+
+		if !tok.quoted && tok.text == "}" {
+			if !nested {
+				return nil, fmt.Errorf("%s:%d: unexpected }", p.path, tok.line)
+			}
+			return directives, nil
+		}
+		if !tok.quoted && (tok.text == "{" || tok.text == ";") {
+			return nil, fmt.Errorf("%s:%d: unexpected %s", p.path, tok.line, tok.text)
+		}
+
+		d := &nginxDirective{Name: tok.text, File: p.path, Line: tok.line}
+		for {
+			if p.pos >= len(p.tokens) {
+				return nil, fmt.Errorf("%s:%d: unexpected end of file", p.path, tok.line)
+			}
+			next := p.tokens[p.pos]
+			p.pos++
+			if !next.quoted && next.text == ";" {
+				break
+			}
+			if !next.quoted && next.text == "{" {
+				block, err := p.block(true)
+				if err != nil {
+					return nil, err
+				}
+				d.Block = block
+				if d.Block == nil {
+					d.Block = []*nginxDirective{}
+				}
+				break
+			}
+			if !next.quoted && next.text == "}" {
+				return nil, fmt.Errorf("%s:%d: unexpected }", p.path, next.line)
+			}
+			d.Args = append(d.Args, next.text)
+		}
+
+		if d.Name == "include" && d.Block == nil && len(d.Args) == 1 {
+			included, err := p.include(d.Args[0])
+			if err != nil {
+				return nil, err
+			}
+			directives = append(directives, included...)
+			continue
+		}
+		directives = append(directives, d)
+	}
+	if nested {
+		return nil, fmt.Errorf("%s: unexpected end of file, missing }", p.path)
+	}
+	return directives, nil
+}
+
+func (p *nginxParser) include(pattern string) ([]*nginxDirective, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(p.path), pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	var directives []*nginxDirective
+	for _, match := range matches {
+		included, err := parseNginx(match, p.seen)
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, included...)
+	}
+	return directives, nil
+}
+
+// nginxImporter 将 nginx 的 server 块转换为虚拟主机
+type nginxImporter struct {
+	conf       *config
+	listeners  map[string]int
+	upstreams  map[string]string
+	notes      []string
+	hasDefault bool
+}
+
+// rewriteNote 是 rewrite、return 和 try_files 无法转换时的提示，这些规则需要改写为 .htaccess 中的重写规则
+const rewriteNote = "not translated, port it to RewriteRule/RewriteCond in .htaccess and set \"htaccess\": true on the vhost"
+
+// ImportNginx 将 nginx 配置中的 server 块转换为 Bronya 配置，
+// 返回的 notes 列出了无法转换的指令
+func ImportNginx(path string) (*config, []string, error) {
+	directives, err := parseNginx(path, make(map[string]bool))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	imp := &nginxImporter{
+		conf:      &config{},
+		listeners: make(map[string]int),
+		upstreams: make(map[string]string),
+	}
+
+	var servers []*nginxDirective
+	var walk func([]*nginxDirective)
+	walk = func(list []*nginxDirective) {
+		for _, d := range list {
+			switch {
+			case d.Name == "http" && d.Block != nil:
+				walk(d.Block)
+			case d.Name == "upstream" && d.Block != nil && len(d.Args) == 1:
+				for _, s := range d.Block {
+					if s.Name == "server" && len(s.Args) > 0 {
+						imp.upstreams[d.Args[0]] = s.Args[0]
+						break
+					}
+				}
+				if len(d.Block) > 1 {
+					imp.note(d, "only the first upstream server is used")
+				}
+			case d.Name == "server" && d.Block != nil:
+				servers = append(servers, d)
+			case d.Name == "events" || d.Name == "stream" || d.Name == "mail":
+				imp.note(d, "block ignored")
+			}
+		}
+	}
+	walk(directives)
+
+	if len(servers) == 0 {
+		return nil, nil, fmt.Errorf("%s: no server blocks found", path)
+	}
+	for _, server := range servers {
+		imp.server(server)
+	}
+	if !imp.hasDefault {
+		imp.conf.Default = imp.conf.Vhosts[0]
+	}
+	imp.conf.Default.Name = nil
+	return imp.conf, imp.notes, nil
+}
+
+func (imp *nginxImporter) note(d *nginxDirective, reason string) {
+	imp.notes = append(imp.notes, d.String()+": "+reason)
+}
+
+func (imp *nginxImporter) server(server *nginxDirective) {
+	host := Vhost{}
+	var listens []*nginxDirective
+	var cert, key string
+	isDefault := false
+
+	for _, d := range server.Block {
+		if len(d.Args) == 0 && d.Block == nil {
+			imp.note(d, "missing arguments")
+			continue
+		}
+		switch d.Name {
+		case "listen":
+			listens = append(listens, d)
+		case "server_name":
+			for _, name := range d.Args {
+				switch {
+				case name == "_" || name == "":
+				case strings.HasPrefix(name, "~") || strings.Contains(name, "*") || strings.HasPrefix(name, "."):
+					imp.note(d, "wildcard and regex server names are not supported, skipped "+name)
+				default:
+					host.Name = append(host.Name, name)
+				}
+			}
+		case "root":
+			host.Root = d.Args[0]
+		case "index":
+			host.Index = d.Args
+		case "fastcgi_pass":
+			imp.fastcgi(&host, d)
+		case "ssl_certificate":
+			cert = d.Args[0]
+		case "ssl_certificate_key":
+			key = d.Args[0]
+		case "location":
+			imp.location(&host, d)
+		case "proxy_pass":
+			imp.note(d, "not translated, Bronya has no proxy mode")
+		case "return", "rewrite", "try_files":
+			imp.note(d, rewriteNote)
+		default:
+			imp.note(d, "ignored")
+		}
+	}
+
+	if len(listens) == 0 {
+		// nginx 未配置 listen 时默认监听 *:80
+		listens = append(listens, &nginxDirective{Name: "listen", Args: []string{"80"}, File: server.File, Line: server.Line})
+	}
+	for _, d := range listens {
+		name, def := imp.listen(d, cert, key)
+		if name != "" && !contains(host.Listeners, name) {
+			host.Listeners = append(host.Listeners, name)
+		}
+		isDefault = isDefault || def
+	}
+
+	if host.Root == "" {
+		imp.note(server, "server has no root, set one before using the generated config")
+	}
+
+	if isDefault && !imp.hasDefault {
+		imp.hasDefault = true
+		imp.conf.Default = host
+	}
+	if len(host.Name) > 0 || !isDefault {
+		imp.conf.Vhosts = append(imp.conf.Vhosts, host)
+	}
+}
+
+// listen 转换 listen 指令，返回监听器名称以及是否为 default_server
+func (imp *nginxImporter) listen(d *nginxDirective, cert, key string) (string, bool) {
+	if len(d.Args) == 0 {
+		imp.note(d, "missing address")
+		return "", false
+	}
+
+	ln := Listener{}
+	addr := d.Args[0]
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		ln.Socket = strings.TrimPrefix(addr, "unix:")
+	case isNumber(addr):
+		ln.Port = addr
+	default:
+		i := strings.LastIndex(addr, ":")
+		if i < 0 || strings.HasSuffix(addr, "]") {
+			ln.Address, ln.Port = addr, "80"
+		} else {
+			ln.Address, ln.Port = addr[:i], addr[i+1:]
+		}
+		ln.Address = strings.Trim(ln.Address, "[]")
+		if ln.Address == "*" || ln.Address == "::" || ln.Address == "0.0.0.0" {
+			// 通配地址统一由一个双栈监听器处理
+			ln.Address = ""
+		}
+	}
+
+	isDefault := false
+	for _, flag := range d.Args[1:] {
+		switch flag {
+		case "ssl":
+			ln.Protocol = "tls"
+		case "default_server", "default":
+			isDefault = true
+		case "proxy_protocol":
+			ln.Proxy.Enable = true
+			if ln.Socket == "" {
+				imp.note(d, "proxy_protocol needs proxy_protocol.trusted to be set on the listener")
+			}
+		default:
+			imp.note(d, "listen parameter "+flag+" ignored")
+		}
+	}
+
+	identity := ln.Network() + "://" + ln.Addr()
+	if i, ok := imp.listeners[identity]; ok {
+		existing := &imp.conf.Listeners[i]
+		if existing.Protocol != ln.Protocol {
+			imp.note(d, "conflicts with "+existing.Name+", plain and ssl on the same address")
+		}
+		if ln.Protocol == "tls" && cert != "" && existing.Cert != "" && existing.Cert != cert {
+			imp.note(d, "certificate "+cert+" ignored, "+existing.Name+" already uses "+existing.Cert+" (no per-vhost certificates)")
+		}
+		if existing.Cert == "" && ln.Protocol == "tls" {
+			existing.Cert, existing.Key = cert, key
+		}
+		existing.Proxy.Enable = existing.Proxy.Enable || ln.Proxy.Enable
+		return existing.Name, isDefault
+	}
+
+	if ln.Protocol == "tls" {
+		ln.Cert, ln.Key = cert, key
+		if cert == "" {
+			imp.note(d, "ssl listener without ssl_certificate")
+		}
+	}
+
+	scheme := "http"
+	if ln.Protocol == "tls" {
+		scheme = "https"
+	}
+	switch {
+	case ln.Socket != "":
+		ln.Name = "unix-" + strings.TrimSuffix(filepath.Base(ln.Socket), filepath.Ext(ln.Socket))
+	case ln.Address == "":
+		ln.Name = scheme + "-" + ln.Port
+	default:
+		ln.Name = scheme + "-" + ln.Address + "-" + ln.Port
+	}
+
+	imp.listeners[identity] = len(imp.conf.Listeners)
+	imp.conf.Listeners = append(imp.conf.Listeners, ln)
+	return ln.Name, isDefault
+}
+
+func (imp *nginxImporter) fastcgi(host *Vhost, d *nginxDirective) {
+	addr := d.Args[0]
+	if upstream, ok := imp.upstreams[addr]; ok {
+		addr = upstream
+	}
+
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		host.Fastcgi = fastcgi{Network: "unix", Address: strings.TrimPrefix(addr, "unix:")}
+	case strings.Contains(addr, ":"):
+		host.Fastcgi = fastcgi{Network: "tcp", Address: addr}
+	default:
+		imp.note(d, "unknown upstream "+addr)
+	}
+}
+
+func (imp *nginxImporter) location(host *Vhost, loc *nginxDirective) {
+	pattern := strings.Join(loc.Args, " ")
+	php := strings.Contains(pattern, "php")
+	root := pattern == "/"
+
+	for _, d := range loc.Block {
+		if len(d.Args) == 0 && d.Block == nil {
+			imp.note(d, "missing arguments")
+			continue
+		}
+		switch {
+		case d.Name == "fastcgi_pass":
+			if !php {
+				imp.note(d, "FastCGI is only used for .php files")
+			}
+			imp.fastcgi(host, d)
+		case root && d.Name == "root" && host.Root == "":
+			host.Root = d.Args[0]
+		case root && d.Name == "index" && len(host.Index) == 0:
+			host.Index = d.Args
+		case d.Name == "proxy_pass":
+			imp.note(d, "not translated, Bronya has no proxy mode")
+		case d.Name == "return" || d.Name == "rewrite" || d.Name == "try_files":
+			imp.note(d, rewriteNote)
+		case php && strings.HasPrefix(d.Name, "fastcgi_"):
+			imp.note(d, "ignored, Bronya builds the FastCGI parameters itself")
+		default:
+			imp.note(d, "not translated, Bronya has no location blocks (location "+pattern+")")
+		}
+	}
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,546 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kotoyuuko/bronya/netutil"
+)
+
+// fastcgiDialTimeout 校验 FastCGI 地址时的连接超时
+const fastcgiDialTimeout = 500 * time.Millisecond
+
+// Problem 存储校验配置时发现的问题
+type Problem struct {
+	Path    string
+	Message string
+	Warning bool
+}
+
+func (p Problem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	if p.Path == "" {
+		return level + ": " + p.Message
+	}
+	return level + ": " + p.Path + ": " + p.Message
+}
+
+// Problems 校验配置时发现的所有问题
+type Problems []Problem
+
+func (ps Problems) Error() string {
+	lines := make([]string, len(ps))
+	for i, p := range ps {
+		lines[i] = p.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// HasErrors 判断是否存在错误
+func (ps Problems) HasErrors() bool {
+	for _, p := range ps {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors 返回其中的错误
+func (ps Problems) Errors() Problems {
+	var errs Problems
+	for _, p := range ps {
+		if !p.Warning {
+			errs = append(errs, p)
+		}
+	}
+	return errs
+}
+
+// Warnings 返回其中的警告
+func (ps Problems) Warnings() Problems {
+	var warnings Problems
+	for _, p := range ps {
+		if p.Warning {
+			warnings = append(warnings, p)
+		}
+	}
+	return warnings
+}
+
+func (ps *Problems) errorf(path string, format string, args ...interface{}) {
+	*ps = append(*ps, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (ps *Problems) warnf(path string, format string, args ...interface{}) {
+	*ps = append(*ps, Problem{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// jsonKey 返回字段在配置文件中的键名
+func jsonKey(f reflect.StructField) string {
+	if tag := f.Tag.Get("json"); tag != "" {
+		return strings.Split(tag, ",")[0]
+	}
+	return strings.ToLower(f.Name)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// checkKeys 对照配置结构检查未知的键、大小写错误的键以及类型不匹配的值
+func checkKeys(path string, value interface{}, t reflect.Type, problems *Problems) {
+	if value == nil {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		checkKeys(path, value, t.Elem(), problems)
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			problems.errorf(path, "expected string, got %s", jsonKind(value))
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			problems.errorf(path, "expected boolean, got %s", jsonKind(value))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) || reflect.New(t).Elem().OverflowInt(int64(n)) {
+			problems.errorf(path, "expected integer, got %s", jsonKind(value))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) || n < 0 || reflect.New(t).Elem().OverflowUint(uint64(n)) {
+			problems.errorf(path, "expected non-negative integer, got %s", jsonKind(value))
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := value.(float64); !ok {
+			problems.errorf(path, "expected number, got %s", jsonKind(value))
+		}
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			problems.errorf(path, "expected array, got %s", jsonKind(value))
+			return
+		}
+		for i, v := range list {
+			checkKeys(path+"["+strconv.Itoa(i)+"]", v, t.Elem(), problems)
+		}
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			problems.errorf(path, "expected object, got %s", jsonKind(value))
+			return
+		}
+
+		fields := make(map[string]reflect.StructField)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+				continue
+			}
+			fields[jsonKey(f)] = f
+		}
+
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if f, ok := fields[key]; ok {
+				checkKeys(joinPath(path, key), object[key], f.Type, problems)
+				continue
+			}
+
+			suggestion := ""
+			for name := range fields {
+				if strings.EqualFold(name, key) || strings.EqualFold(strings.Replace(name, "_", "", -1), key) {
+					suggestion = name
+				}
+			}
+			if suggestion != "" {
+				problems.errorf(joinPath(path, key), "unknown key, did you mean %q?", suggestion)
+			} else {
+				problems.errorf(joinPath(path, key), "unknown key")
+			}
+		}
+	}
+}
+
+// jsonKind 返回 JSON 值的类型名称，数字附带其值
+func jsonKind(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number " + strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "null"
+}
+
+// validate 校验配置内容
+func (conf *config) validate(problems *Problems) {
+	if conf.KeepAliveTimeout < 0 {
+		problems.errorf("keepalive_timeout", "must not be negative")
+	}
+	if conf.ShutdownTimeout < 0 {
+		problems.errorf("shutdown_timeout", "must not be negative")
+	}
+	if conf.MaxBodySize < 0 {
+		problems.errorf("max_body_size", "must not be negative")
+	}
+
+	listeners := make(map[string]string)
+	addrs := make(map[string]string)
+	for i := range conf.Listeners {
+		ln := &conf.Listeners[i]
+		path, addressKey := "listeners["+strconv.Itoa(i)+"]", "address"
+		if conf.implicitListener {
+			// 未配置 listeners 时监听器来自顶层的 listen 和 port
+			path, addressKey = "", "listen"
+		}
+		validateListener(path, addressKey, ln, problems)
+
+		if prev, ok := listeners[ln.Name]; ok {
+			problems.errorf(joinPath(path, "name"), "duplicate listener name %q, already used by %s", ln.Name, prev)
+		} else {
+			listeners[ln.Name] = path
+		}
+		addr := ln.Network() + "://" + ln.Addr()
+		if prev, ok := addrs[addr]; ok {
+			problems.errorf(path, "address %s already used by %s", addr, prev)
+		} else {
+			addrs[addr] = path
+		}
+	}
+
+	if conf.Admin.Listener != "" {
+		ln := conf.AdminListener()
+		switch {
+		case ln == nil:
+			problems.errorf("admin.listener", "unknown listener %q", conf.Admin.Listener)
+		case ln.Network() != "unix" && conf.Admin.Token == "":
+			problems.errorf("admin.token", "required when the admin listener is not a unix socket")
+		}
+		if ln != nil && len(conf.Listeners) == 1 {
+			problems.warnf("admin.listener", "the only listener is used by the admin API, no vhost is reachable")
+		}
+		if ln != nil && ln.Proxy.Enable {
+			problems.warnf("admin.listener", "listener %q expects a PROXY header, bronya cache cannot connect to it", ln.Name)
+		}
+	} else if conf.Admin.Token != "" {
+		problems.warnf("admin.token", "admin.listener is not set, the admin API is disabled")
+	}
+
+	if conf.Metrics.Listener != "" {
+		if conf.listener(conf.Metrics.Listener) == nil {
+			problems.errorf("metrics.listener", "unknown listener %q", conf.Metrics.Listener)
+		}
+		if !strings.HasPrefix(conf.Metrics.Path, "/") {
+			problems.errorf("metrics.path", "must start with /")
+		}
+		if _, err := netutil.ParseCIDRs(conf.Metrics.Allow); err != nil {
+			problems.errorf("metrics.allow", "%v", err)
+		}
+		if len(conf.Metrics.Allow) == 0 {
+			problems.warnf("metrics.allow", "empty, metrics are visible to every client of listener %q", conf.Metrics.Listener)
+		}
+	}
+
+	if !validLogLevel(conf.Log.Level) {
+		problems.errorf("log.level", "unknown level %q, expected debug, info, warn or error", conf.Log.Level)
+	}
+	if conf.Log.Format != "text" && conf.Log.Format != "json" {
+		problems.errorf("log.format", "unknown format %q, expected text or json", conf.Log.Format)
+	}
+	for i, out := range conf.Log.Outputs {
+		outPath := "log.outputs[" + strconv.Itoa(i) + "]"
+		if out.Path == "" {
+			problems.errorf(joinPath(outPath, "path"), "required")
+		}
+		if out.Level != "" && !validLogLevel(out.Level) {
+			problems.errorf(joinPath(outPath, "level"), "unknown level %q, expected debug, info, warn or error", out.Level)
+		}
+		if out.Format != "" && out.Format != "text" && out.Format != "json" {
+			problems.errorf(joinPath(outPath, "format"), "unknown format %q, expected text or json", out.Format)
+		}
+		out.Rotate.validate(joinPath(outPath, "rotate"), out.Path, problems)
+	}
+
+	conf.AccessLog.validate("access_log", problems)
+
+	if conf.AssetCache.MaxSize < 0 {
+		problems.errorf("asset_cache.max_size", "must not be negative")
+	}
+	if conf.AssetCache.MaxEntrySize < 0 {
+		problems.errorf("asset_cache.max_entry_size", "must not be negative")
+	}
+
+	if conf.FileCache.MaxEntries < 0 {
+		problems.errorf("file_cache.max_entries", "must not be negative")
+	}
+	if conf.FileCache.MaxOpen < 0 {
+		problems.errorf("file_cache.max_open", "must not be negative")
+	}
+	if conf.FileCache.TTL < 0 {
+		problems.errorf("file_cache.ttl", "must not be negative")
+	}
+
+	if conf.Cache.MaxSize < 0 {
+		problems.errorf("cache.max_size", "must not be negative")
+	}
+
+	if _, err := netutil.ParseCIDRs(conf.RealIP.Trusted); err != nil {
+		problems.errorf("real_ip.trusted", "%v", err)
+	}
+	switch strings.ToLower(conf.RealIP.Header) {
+	case "", "x-forwarded-for", "x-real-ip", "forwarded":
+	default:
+		problems.warnf("real_ip.header", "unusual header %q, expected X-Forwarded-For, X-Real-IP or Forwarded", conf.RealIP.Header)
+	}
+
+	dialed := make(map[string]error)
+	names := make(map[string]string)
+	for i := range conf.Vhosts {
+		host := &conf.Vhosts[i]
+		path := "vhosts[" + strconv.Itoa(i) + "]"
+		if len(host.Name) == 0 {
+			problems.warnf(joinPath(path, "name"), "vhost has no names and can never be selected")
+		}
+		for j, name := range host.Name {
+			namePath := joinPath(path, "name["+strconv.Itoa(j)+"]")
+			if prev, ok := names[strings.ToLower(name)]; ok {
+				problems.errorf(namePath, "duplicate vhost name %q, already used by %s", name, prev)
+			} else {
+				names[strings.ToLower(name)] = namePath
+			}
+		}
+		host.validate(path, listeners, dialed, problems)
+		for j, name := range host.Listeners {
+			if conf.Admin.Listener != "" && name == conf.Admin.Listener {
+				problems.warnf(joinPath(path, "listeners["+strconv.Itoa(j)+"]"), "listener %q is used by the admin API, the vhost is not reachable through it", name)
+			}
+		}
+	}
+	conf.Default.validate("default", listeners, dialed, problems)
+}
+
+func validateListener(path, addressKey string, ln *Listener, problems *Problems) {
+	if ln.Network() == "tcp" {
+		port, err := strconv.Atoi(ln.Port)
+		if err != nil || port < 1 || port > 65535 {
+			problems.errorf(joinPath(path, "port"), "invalid port %q, must be 1-65535", ln.Port)
+		}
+		if ln.Address != "" && net.ParseIP(ln.Address) == nil {
+			if _, err := net.LookupHost(ln.Address); err != nil {
+				problems.errorf(joinPath(path, addressKey), "cannot resolve %q", ln.Address)
+			}
+		}
+	} else if ln.Mode != "" {
+		if _, err := strconv.ParseUint(ln.Mode, 8, 32); err != nil {
+			problems.errorf(joinPath(path, "mode"), "invalid octal permission %q", ln.Mode)
+		}
+	}
+
+	switch ln.Protocol {
+	case "plain":
+	case "tls":
+		if ln.Cert == "" {
+			problems.errorf(joinPath(path, "cert"), "required for tls listeners")
+		} else if _, err := os.Stat(ln.Cert); err != nil {
+			problems.errorf(joinPath(path, "cert"), "file does not exist")
+		}
+		if ln.Key == "" {
+			problems.errorf(joinPath(path, "key"), "required for tls listeners")
+		} else if _, err := os.Stat(ln.Key); err != nil {
+			problems.errorf(joinPath(path, "key"), "file does not exist")
+		}
+	default:
+		problems.errorf(joinPath(path, "protocol"), "unknown protocol %q, expected plain or tls", ln.Protocol)
+	}
+
+	if _, err := netutil.ParseCIDRs(ln.Proxy.Trusted); err != nil {
+		problems.errorf(joinPath(path, "proxy_protocol.trusted"), "%v", err)
+	} else if ln.Proxy.Enable && len(ln.Proxy.Trusted) == 0 && ln.Network() != "unix" {
+		problems.errorf(joinPath(path, "proxy_protocol.trusted"), "required when proxy_protocol is enabled, otherwise any client could spoof its address")
+	}
+	if ln.Proxy.Timeout < 0 {
+		problems.errorf(joinPath(path, "proxy_protocol.timeout"), "must not be negative")
+	}
+}
+
+func (r *Rotate) validate(path, file string, problems *Problems) {
+	switch r.Interval {
+	case "", "hourly", "daily", "weekly":
+	default:
+		problems.errorf(joinPath(path, "interval"), "unknown interval %q, expected hourly, daily or weekly", r.Interval)
+	}
+	if r.MaxSize < 0 {
+		problems.errorf(joinPath(path, "max_size"), "must not be negative")
+	}
+	if r.Keep < 0 {
+		problems.errorf(joinPath(path, "keep"), "must not be negative")
+	}
+	if (r.MaxSize > 0 || r.Interval != "") && !isLogFile(file) {
+		problems.warnf(path, "%s is not a file, rotation is ignored", file)
+	}
+}
+
+// isLogFile 判断日志路径是否为普通文件
+func isLogFile(path string) bool {
+	switch path {
+	case "", "off", "stdout", "stderr", "syslog":
+		return false
+	}
+	return !strings.HasPrefix(path, "syslog:")
+}
+
+func validLogLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "warning", "error":
+		return true
+	}
+	return false
+}
+
+func (host *Vhost) validate(path string, listeners map[string]string, dialed map[string]error, problems *Problems) {
+	if host.Root == "" {
+		problems.errorf(joinPath(path, "root"), "required")
+	} else if fi, err := os.Stat(host.Root); err != nil {
+		problems.errorf(joinPath(path, "root"), "directory does not exist")
+	} else if !fi.IsDir() {
+		problems.errorf(joinPath(path, "root"), "not a directory")
+	}
+
+	host.AccessLog.validate(joinPath(path, "access_log"), problems)
+
+	if len(host.Index) == 0 && !host.Autoindex.Enable {
+		problems.warnf(joinPath(path, "index"), "no index files and autoindex disabled, directory requests will return 404")
+	}
+	for i, pattern := range host.Deny.Patterns {
+		if _, err := ParseDenyRule(pattern); err != nil {
+			problems.errorf(joinPath(path, "deny.patterns["+strconv.Itoa(i)+"]"), "invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if host.Deny.Status != 403 && host.Deny.Status != 404 {
+		problems.errorf(joinPath(path, "deny.status"), "must be 403 or 404")
+	}
+
+	for i, encoding := range host.Compression.Encodings {
+		if !contains(Encodings, encoding) {
+			problems.errorf(joinPath(path, "compression.encodings["+strconv.Itoa(i)+"]"), "unknown encoding %q, expected one of %s", encoding, strings.Join(Encodings, ", "))
+		}
+	}
+	for i, pattern := range host.Compression.Types {
+		if !validTypePattern(pattern) {
+			problems.errorf(joinPath(path, "compression.types["+strconv.Itoa(i)+"]"), "invalid MIME type pattern %q", pattern)
+		}
+	}
+	if host.Compression.MinSize < 0 {
+		problems.errorf(joinPath(path, "compression.min_size"), "must not be negative")
+	}
+
+	cache := host.Cache
+	if cache.Enable && (host.Fastcgi.Network == "" || host.Fastcgi.Address == "") {
+		problems.warnf(joinPath(path, "cache.enable"), "fastcgi is not configured, nothing will be cached")
+	}
+	if cache.TTL < 0 {
+		problems.errorf(joinPath(path, "cache.ttl"), "must not be negative")
+	}
+	if cache.StaleWhileRevalidate < 0 {
+		problems.errorf(joinPath(path, "cache.stale_while_revalidate"), "must not be negative")
+	}
+	if cache.StaleIfError < 0 {
+		problems.errorf(joinPath(path, "cache.stale_if_error"), "must not be negative")
+	}
+	for i, part := range cache.Key {
+		if !validKeyPart(part) {
+			problems.errorf(joinPath(path, "cache.key["+strconv.Itoa(i)+"]"), "unknown key part %q, expected scheme, host, uri, path, query, method, header:<name> or cookie:<name>", part)
+		}
+	}
+	for i, pattern := range cache.BypassCookies {
+		if !validGlob(pattern) {
+			problems.errorf(joinPath(path, "cache.bypass_cookies["+strconv.Itoa(i)+"]"), "invalid pattern %q", pattern)
+		}
+	}
+
+	switch host.Symlinks {
+	case "", "follow", "owner", "deny":
+	default:
+		problems.errorf(joinPath(path, "symlinks"), "unknown policy %q, expected follow, owner or deny", host.Symlinks)
+	}
+	switch host.Autoindex.Format {
+	case "", "html", "json", "plain":
+	default:
+		problems.errorf(joinPath(path, "autoindex.format"), "unknown format %q, expected html, json or plain", host.Autoindex.Format)
+	}
+
+	if host.Status.Path != "" {
+		if !strings.HasPrefix(host.Status.Path, "/") {
+			problems.errorf(joinPath(path, "status.path"), "must start with /")
+		}
+		if _, err := netutil.ParseCIDRs(host.Status.Allow); err != nil {
+			problems.errorf(joinPath(path, "status.allow"), "%v", err)
+		}
+		if len(host.Status.Allow) == 0 {
+			problems.warnf(joinPath(path, "status.allow"), "empty, the status page is visible to every client")
+		}
+	}
+
+	for i, name := range host.Listeners {
+		if _, ok := listeners[name]; !ok {
+			problems.errorf(joinPath(path, "listeners["+strconv.Itoa(i)+"]"), "unknown listener %q", name)
+		}
+	}
+
+	fcgi := host.Fastcgi
+	if fcgi.Network == "" && fcgi.Address == "" {
+		return
+	}
+	switch fcgi.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		problems.errorf(joinPath(path, "fastcgi.network"), "unknown network %q, expected tcp or unix", fcgi.Network)
+		return
+	}
+	if fcgi.Address == "" {
+		problems.errorf(joinPath(path, "fastcgi.address"), "required")
+		return
+	}
+
+	key := fcgi.Network + "://" + fcgi.Address
+	err, ok := dialed[key]
+	if !ok {
+		var conn net.Conn
+		conn, err = net.DialTimeout(fcgi.Network, fcgi.Address, fastcgiDialTimeout)
+		if err == nil {
+			conn.Close()
+		}
+		dialed[key] = err
+	}
+	if err != nil {
+		problems.warnf(joinPath(path, "fastcgi.address"), "cannot connect: %v", err)
+	}
+}
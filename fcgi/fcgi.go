@@ -373,34 +373,7 @@ func (client *Client) Request(p map[string]string, req io.Reader) (resp *http.Re
 	rb := bufio.NewReader(r)
 	tp := textproto.NewReader(rb)
 	resp = new(http.Response)
-	line, err := tp.ReadLine()
-	if err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
-		}
-		return nil, err
-	}
-	if i := strings.IndexByte(line, ' '); i == -1 {
-		err = &badStringError{"malformed HTTP response", line}
-	} else {
-		resp.Proto = line[:i]
-		resp.Status = strings.TrimLeft(line[i+1:], " ")
-	}
-	statusCode := resp.Status
-	if i := strings.IndexByte(resp.Status, ' '); i != -1 {
-		statusCode = resp.Status[:i]
-	}
-	if len(statusCode) != 3 {
-		err = &badStringError{"malformed HTTP status code", statusCode}
-	}
-	resp.StatusCode, err = strconv.Atoi(statusCode)
-	if err != nil || resp.StatusCode < 0 {
-		err = &badStringError{"malformed HTTP status code", statusCode}
-	}
-	var ok bool
-	if resp.ProtoMajor, resp.ProtoMinor, ok = http.ParseHTTPVersion(resp.Proto); !ok {
-		err = &badStringError{"malformed HTTP version", resp.Proto}
-	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
 	mimeHeader, err := tp.ReadMIMEHeader()
 	if err != nil {
 		if err == io.EOF {
@@ -409,6 +382,24 @@ func (client *Client) Request(p map[string]string, req io.Reader) (resp *http.Re
 		return nil, err
 	}
 	resp.Header = http.Header(mimeHeader)
+
+	// CGI 响应没有状态行，状态码来自 Status 头部，只有 Location 时为 302
+	resp.StatusCode = http.StatusOK
+	if status := resp.Header.Get("Status"); status != "" {
+		code := status
+		if i := strings.IndexByte(status, ' '); i != -1 {
+			code = status[:i]
+		}
+		resp.StatusCode, err = strconv.Atoi(code)
+		if err != nil || len(code) != 3 {
+			return nil, &badStringError{"malformed CGI status", status}
+		}
+		resp.Header.Del("Status")
+	} else if resp.Header.Get("Location") != "" {
+		resp.StatusCode = http.StatusFound
+	}
+	resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+
 	resp.TransferEncoding = resp.Header["Transfer-Encoding"]
 	resp.ContentLength, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
 
@@ -0,0 +1,13 @@
+module github.com/kotoyuuko/bronya
+
+go 1.23
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/fsnotify/fsnotify v1.10.1
+	github.com/klauspost/compress v1.18.0
+	github.com/pelletier/go-toml v1.9.5
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.13.0 // indirect
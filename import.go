@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/kotoyuuko/bronya/config"
+)
+
+func importNginx(args []string) int {
+	flags := flag.NewFlagSet("bronya import-nginx", flag.ExitOnError)
+	output := flags.String("o", "", "write the config to this file instead of stdout")
+	format := flags.String("f", "", "output format: json, yaml or toml (default from -o extension, else json)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: bronya import-nginx [-o file] [-f format] <nginx.conf>")
+		return 2
+	}
+
+	conf, notes, err := config.ImportNginx(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(*output)), ".")
+	}
+	content, err := conf.Encode(*format)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *output == "" {
+		os.Stdout.Write(content)
+	} else if err := ioutil.WriteFile(*output, content, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if len(notes) > 0 {
+		fmt.Fprintln(os.Stderr, len(notes), "directives could not be translated:")
+		for _, note := range notes {
+			fmt.Fprintln(os.Stderr, "  "+note)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,262 @@
+package logger
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateOptions 日志文件轮转的设置，MaxSize 为 0 且 Interval 为空时不轮转，
+// Keep 为 0 时保留所有轮转文件
+type RotateOptions struct {
+	MaxSize  int64
+	Interval string
+	Keep     int
+	Compress bool
+}
+
+// Period 返回时间所属的轮转周期，周期变化时需要轮转
+func (r RotateOptions) Period(t time.Time) string {
+	switch r.Interval {
+	case "hourly":
+		return t.Format("2006010215")
+	case "daily":
+		return t.Format("20060102")
+	case "weekly":
+		year, week := t.ISOWeek()
+		return strconv.Itoa(year) + "-" + strconv.Itoa(week)
+	}
+	return ""
+}
+
+// File 是按大小或时间轮转的日志文件，收到 SIGUSR1 时可以重新打开
+type File struct {
+	mutex  sync.Mutex
+	path   string
+	rotate RotateOptions
+	file   *os.File
+	size   int64
+	period string
+	closed bool
+}
+
+var (
+	filesMutex sync.Mutex
+	files      = make(map[*File]struct{})
+)
+
+// OpenFile 以追加模式打开日志文件
+func OpenFile(path string, rotate RotateOptions) (*File, error) {
+	f := &File{path: path, rotate: rotate}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	filesMutex.Lock()
+	files[f] = struct{}{}
+	filesMutex.Unlock()
+	return f, nil
+}
+
+// Reopen 重新打开所有日志文件，用于配合外部的 logrotate
+func Reopen() error {
+	filesMutex.Lock()
+	list := make([]*File, 0, len(files))
+	for f := range files {
+		list = append(list, f)
+	}
+	filesMutex.Unlock()
+
+	var first error
+	for _, f := range list {
+		if err := f.Reopen(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, fi.Size()
+	// 文件中已有内容时按修改时间计算所属周期，重启后也能按时轮转
+	modTime := time.Now()
+	if f.size > 0 {
+		modTime = fi.ModTime()
+	}
+	f.period = f.rotate.Period(modTime)
+	return nil
+}
+
+// Write 写入日志，写入前检查是否需要轮转
+func (f *File) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file == nil {
+		// 上次打开失败时重试
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if f.size > 0 && (f.rotate.MaxSize > 0 && f.size+int64(len(p)) > f.rotate.MaxSize ||
+		f.rotate.Interval != "" && f.rotate.Period(time.Now()) != f.period) {
+		if err := f.rotateLocked(); err != nil {
+			// 错误日志可能就是当前文件，不能在持有锁时写入
+			go Error.Println("rotate", f.path+":", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Reopen 关闭并重新打开日志文件
+func (f *File) Reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	return f.open()
+}
+
+// Close 关闭日志文件
+func (f *File) Close() error {
+	filesMutex.Lock()
+	delete(files, f)
+	filesMutex.Unlock()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// rotateLocked 将当前文件重命名为带时间戳的文件并打开新文件，压缩和清理在后台进行
+func (f *File) rotateLocked() error {
+	name := f.path + "." + time.Now().Format("20060102-150405")
+	for i := 1; exists(name) || exists(name+".gz"); i++ {
+		name = f.path + "." + time.Now().Format("20060102-150405") + "-" + strconv.Itoa(i)
+	}
+
+	f.file.Close()
+	f.file = nil
+	renameErr := os.Rename(f.path, name)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	go func(rotate RotateOptions, path, name string) {
+		if rotate.Compress {
+			if err := compressFile(name); err != nil {
+				Error.Println("compress", name+":", err)
+			}
+		}
+		if rotate.Keep > 0 {
+			prune(path, rotate.Keep)
+		}
+	}(f.rotate, f.path, name)
+	return nil
+}
+
+func exists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+// compressFile 将文件压缩为 .gz 并删除原文件
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz.tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(name+".gz.tmp", name+".gz")
+	}
+	if err != nil {
+		os.Remove(name + ".gz.tmp")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// prune 只保留最新的 keep 个轮转文件
+func prune(path string, keep int) {
+	matches, err := filepath.Glob(path + ".[0-9]*")
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".tmp") {
+			rotated = append(rotated, m)
+		}
+	}
+	sort.Slice(rotated, func(i, j int) bool {
+		ti, ni := rotatedOrder(path, rotated[i])
+		tj, nj := rotatedOrder(path, rotated[j])
+		return ti < tj || ti == tj && ni < nj
+	})
+	for len(rotated) > keep {
+		if err := os.Remove(rotated[0]); err != nil {
+			Error.Println("remove", rotated[0]+":", err)
+		}
+		rotated = rotated[1:]
+	}
+}
+
+// rotatedOrder 从轮转文件名中取出时间戳和同一秒内的序号，用于按时间排序
+func rotatedOrder(path, name string) (string, int) {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, path+"."), ".gz")
+	if i := strings.LastIndexByte(stamp, '-'); i > len("20060102") {
+		if n, err := strconv.Atoi(stamp[i+1:]); err == nil {
+			return stamp[:i], n
+		}
+	}
+	return stamp, 0
+}
@@ -1,27 +1,388 @@
 package logger
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
+// Level 日志级别
+type Level int32
+
+// 日志级别
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel 解析日志级别名称
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, errors.New("unknown log level " + strconv.Quote(name))
+}
+
+var level = int32(LevelInfo)
+
+// SetLevel 修改全局日志级别，未单独设置级别的输出立即生效
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// GetLevel 返回全局日志级别
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+// output 是一个日志输出，level 为负数时使用全局日志级别
+type output struct {
+	mutex  sync.Mutex
+	name   string
+	w      io.Writer
+	closer io.Closer
+	level  Level
+	json   bool
+}
+
+func (o *output) enabled(l Level) bool {
+	if o.level < 0 {
+		return l >= GetLevel()
+	}
+	return l >= o.level
+}
+
+var outputs atomic.Value
+
+func init() {
+	outputs.Store([]*output{{name: "stderr", w: os.Stderr, level: -1}})
+}
+
+// Options 日志的设置
+type Options struct {
+	Level   string
+	Format  string
+	Outputs []OutputOptions
+}
+
+// OutputOptions 一个日志输出的设置，Level 和 Format 为空时使用 Options 中的设置
+type OutputOptions struct {
+	Path   string
+	Level  string
+	Format string
+	Rotate RotateOptions
+}
+
+// Init 按设置打开日志输出并设置日志级别，成功后关闭原来的输出
+func Init(conf Options) error {
+	l, err := ParseLevel(conf.Level)
+	if err != nil {
+		return err
+	}
+
+	var opened []*output
+	for _, out := range conf.Outputs {
+		o, err := openOutput(out, conf.Format)
+		if err != nil {
+			closeOutputs(opened)
+			return err
+		}
+		opened = append(opened, o)
+	}
+
+	old, _ := outputs.Load().([]*output)
+	outputs.Store(opened)
+	SetLevel(l)
+	closeOutputs(old)
+	return nil
+}
+
+func openOutput(conf OutputOptions, format string) (*output, error) {
+	o := &output{name: conf.Path, level: -1}
+	if conf.Level != "" {
+		l, err := ParseLevel(conf.Level)
+		if err != nil {
+			return nil, err
+		}
+		o.level = l
+	}
+	if conf.Format != "" {
+		format = conf.Format
+	}
+	o.json = format == "json"
+
+	switch {
+	case conf.Path == "stderr":
+		o.w = os.Stderr
+	case conf.Path == "stdout":
+		o.w = os.Stdout
+	case conf.Path == "syslog" || strings.HasPrefix(conf.Path, "syslog:"):
+		w, err := openSyslog(strings.TrimPrefix(strings.TrimPrefix(conf.Path, "syslog"), ":"))
+		if err != nil {
+			return nil, err
+		}
+		o.w, o.closer = w, w
+	default:
+		f, err := OpenFile(conf.Path, conf.Rotate)
+		if err != nil {
+			return nil, err
+		}
+		o.w, o.closer = f, f
+	}
+	return o, nil
+}
+
+func closeOutputs(list []*output) {
+	for _, o := range list {
+		if o.closer != nil {
+			o.mutex.Lock()
+			o.closer.Close()
+			o.mutex.Unlock()
+		}
+	}
+}
+
+// record 是一条日志
+type record struct {
+	time   time.Time
+	level  Level
+	caller string
+	msg    string
+	fields []interface{}
+}
+
+// write 将日志写入所有启用了该级别的输出，depth 为日志调用处相对 write 的栈深度
+func write(l Level, depth int, msg string, fields []interface{}) {
+	list, _ := outputs.Load().([]*output)
+	var rec *record
+	var text, js []byte
+	for _, o := range list {
+		if !o.enabled(l) {
+			continue
+		}
+		if rec == nil {
+			rec = &record{time: time.Now(), level: l, msg: msg, fields: fields}
+			if l >= LevelWarn {
+				if _, file, line, ok := runtime.Caller(depth); ok {
+					rec.caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+				}
+			}
+		}
+
+		var line []byte
+		if o.json {
+			if js == nil {
+				js = rec.json()
+			}
+			line = js
+		} else {
+			if text == nil {
+				text = rec.text()
+			}
+			line = text
+		}
+
+		o.mutex.Lock()
+		if sw, ok := o.w.(levelWriter); ok {
+			sw.writeLevel(l, line)
+		} else {
+			o.w.Write(line)
+		}
+		o.mutex.Unlock()
+	}
+}
+
+// levelWriter 是按日志级别写入的输出，例如 syslog
+type levelWriter interface {
+	writeLevel(l Level, line []byte)
+}
+
+// text 使用 key=value 格式编码日志
+func (rec *record) text() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(rec.time.Format("2006/01/02 15:04:05"))
+	buf.WriteString(" [" + strings.ToUpper(rec.level.String()) + "] ")
+	if rec.caller != "" {
+		buf.WriteString(rec.caller + ": ")
+	}
+	buf.WriteString(rec.msg)
+	forEachField(rec.fields, func(key string, value interface{}) {
+		buf.WriteString(" " + key + "=" + quoteValue(formatValue(value)))
+	})
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// json 使用 JSON 格式编码日志，每条日志一行
+func (rec *record) json() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":"` + rec.time.Format("2006-01-02T15:04:05.000Z07:00") + `","level":"` + rec.level.String() + `"`)
+	if rec.caller != "" {
+		buf.WriteString(`,"caller":` + jsonString(rec.caller))
+	}
+	buf.WriteString(`,"msg":` + jsonString(rec.msg))
+	forEachField(rec.fields, func(key string, value interface{}) {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		} else if s, ok := value.(fmt.Stringer); ok {
+			value = s.String()
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			encoded = []byte(jsonString(fmt.Sprint(value)))
+		}
+		buf.WriteString("," + jsonString(key) + ":")
+		buf.Write(encoded)
+	})
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+// forEachField 按 key、value 交替的顺序遍历字段，缺少值的键使用空值
+func forEachField(fields []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		key, ok := fields[i].(string)
+		if !ok {
+			key = fmt.Sprint(fields[i])
+		}
+		var value interface{}
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		fn(key, value)
+	}
+}
+
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case error:
+		return v.Error()
+	}
+	return fmt.Sprint(value)
+}
+
+// quoteValue 在值为空或者包含空白、引号、等号及控制字符时加上引号
+func quoteValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '"' || r == '=' || r == 0x7f || r == utf8.RuneError {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func jsonString(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded)
+}
+
+// Printer 按固定级别输出日志，兼容 log.Logger 的 Println 和 Printf
+type Printer struct {
+	level Level
+}
+
 var (
+	// Debug logger
+	Debug = &Printer{LevelDebug}
 	// Info logger
-	Info *log.Logger
+	Info = &Printer{LevelInfo}
 	// Warning logger
-	Warning *log.Logger
+	Warning = &Printer{LevelWarn}
 	// Error logger
-	Error *log.Logger
+	Error = &Printer{LevelError}
 )
 
-func init() {
-	errFile, err := os.OpenFile("errors.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalln(err)
+// Println 输出以空格分隔的参数
+func (p *Printer) Println(v ...interface{}) {
+	write(p.level, 2, strings.TrimSuffix(fmt.Sprintln(v...), "\n"), nil)
+}
+
+// Printf 按格式输出
+func (p *Printer) Printf(format string, v ...interface{}) {
+	write(p.level, 2, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"), nil)
+}
+
+// Log 输出消息以及按 key、value 交替排列的字段
+func (p *Printer) Log(msg string, kv ...interface{}) {
+	write(p.level, 2, msg, kv)
+}
+
+// Logger 输出带有固定字段的日志
+type Logger struct {
+	fields []interface{}
+}
+
+// With 创建带有字段的 Logger，字段按 key、value 交替排列
+func With(kv ...interface{}) *Logger {
+	return &Logger{fields: kv}
+}
+
+// With 创建在当前字段基础上追加字段的 Logger
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	return &Logger{fields: append(append(fields, l.fields...), kv...)}
+}
+
+func (l *Logger) log(lv Level, msg string, kv []interface{}) {
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = append(append(make([]interface{}, 0, len(l.fields)+len(kv)), l.fields...), kv...)
 	}
+	write(lv, 3, msg, fields)
+}
+
+// Debug 输出调试日志
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+// Info 输出普通日志
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+// Warn 输出警告日志
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
 
-	Info = log.New(os.Stdout, "[INFO]", log.Ldate|log.Ltime)
-	Warning = log.New(os.Stdout, "[WARN]", log.Ldate|log.Ltime|log.Lshortfile)
-	Error = log.New(io.MultiWriter(os.Stderr, errFile), "[ERR]", log.Ldate|log.Ltime|log.Lshortfile)
+// Error 输出错误日志
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
 }
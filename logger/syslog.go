@@ -0,0 +1,45 @@
+package logger
+
+import (
+	"log/syslog"
+	"strings"
+)
+
+// syslogWriter 通过本地 Unix socket 写入 syslog，按日志级别设置优先级
+type syslogWriter struct {
+	*syslog.Writer
+}
+
+// openSyslog 连接 syslog，addr 为空时使用系统默认的 socket
+func openSyslog(addr string) (*syslogWriter, error) {
+	if addr == "" {
+		w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "bronya")
+		if err != nil {
+			return nil, err
+		}
+		return &syslogWriter{w}, nil
+	}
+
+	var err error
+	for _, network := range []string{"unixgram", "unix"} {
+		var w *syslog.Writer
+		if w, err = syslog.Dial(network, addr, syslog.LOG_DAEMON|syslog.LOG_INFO, "bronya"); err == nil {
+			return &syslogWriter{w}, nil
+		}
+	}
+	return nil, err
+}
+
+func (w *syslogWriter) writeLevel(l Level, line []byte) {
+	msg := strings.TrimSuffix(string(line), "\n")
+	switch l {
+	case LevelDebug:
+		w.Debug(msg)
+	case LevelInfo:
+		w.Info(msg)
+	case LevelWarn:
+		w.Warning(msg)
+	default:
+		w.Err(msg)
+	}
+}
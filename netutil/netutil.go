@@ -0,0 +1,47 @@
+package netutil
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseCIDRs 解析 CIDR 或单个 IP 地址列表
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.New("invalid IP address " + strconv.Quote(s))
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ContainsIP 判断 IP 地址是否属于列表中的任一网段，ip 为 nil 时返回 false
+func ContainsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
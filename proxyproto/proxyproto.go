@@ -0,0 +1,319 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kotoyuuko/bronya/netutil"
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const v1MaxLength = 107
+
+// TLV 类型
+const (
+	PP2TypeALPN      byte = 0x01
+	PP2TypeAuthority byte = 0x02
+	PP2TypeCRC32C    byte = 0x03
+	PP2TypeNoop      byte = 0x04
+	PP2TypeUniqueID  byte = 0x05
+	PP2TypeSSL       byte = 0x20
+	PP2TypeNetNS     byte = 0x30
+)
+
+var (
+	// ErrNoHeader 可信来源未发送 PROXY 头部
+	ErrNoHeader = errors.New("proxyproto: missing PROXY header")
+	// ErrInvalidHeader PROXY 头部格式错误
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+)
+
+// TLV 存储 PROXY v2 头部中的扩展字段
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header 存储解析后的 PROXY 头部信息
+type Header struct {
+	Version     int
+	Local       bool
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+// Listener 解析 PROXY 协议的监听器
+type Listener struct {
+	net.Listener
+	Trusted []*net.IPNet
+	Timeout time.Duration
+}
+
+// NewListener 创建 PROXY 协议监听器，只解析 trusted 中的来源发送的头部，trusted 为空时不信任任何 TCP 来源
+func NewListener(listener net.Listener, trusted []string, timeout time.Duration) (*Listener, error) {
+	nets, err := netutil.ParseCIDRs(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{
+		Listener: listener,
+		Trusted:  nets,
+		Timeout:  timeout,
+	}, nil
+}
+
+// Accept 接受连接，头部在第一次读取时解析
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		trusted: l.trusts(conn.RemoteAddr()),
+		timeout: l.Timeout,
+	}, nil
+}
+
+func (l *Listener) trusts(addr net.Addr) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		// Unix socket 上的对端总是本机进程
+		return true
+	}
+	return netutil.ContainsIP(l.Trusted, ip)
+}
+
+// Conn 解析 PROXY 头部后的连接
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	trusted bool
+	timeout time.Duration
+	once    sync.Once
+	header  *Header
+	err     error
+}
+
+// Header 返回连接的 PROXY 头部，来源不可信时返回 nil
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(c.readHeader)
+	return c.header, c.err
+}
+
+// Read 读取 PROXY 头部之后的数据
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr 返回 PROXY 头部中的客户端地址
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && !c.header.Local && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr 返回 PROXY 头部中的目标地址
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.header != nil && !c.header.Local && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) readHeader() {
+	if !c.trusted {
+		return
+	}
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+	c.header, c.err = ReadHeader(c.reader)
+}
+
+// ReadHeader 从 reader 中读取 PROXY v1 或 v2 头部
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case v1Prefix[0]:
+		return readV1(r)
+	case v2Signature[0]:
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, v1Prefix) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		header.Local = true
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+
+	src := net.ParseIP(fields[2])
+	dst := net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, ErrInvalidHeader
+	}
+	if v4 := fields[1] == "TCP4"; v4 != (src.To4() != nil) || v4 != (dst.To4() != nil) {
+		return nil, ErrInvalidHeader
+	}
+
+	header.Source = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	header.Destination = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return header, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[:12], v2Signature) {
+		return nil, ErrInvalidHeader
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+
+	length := int(binary.BigEndian.Uint16(fixed[14:16]))
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	header := &Header{Version: 2}
+	switch fixed[12] & 0x0F {
+	case 0x00:
+		header.Local = true
+		return header, nil
+	case 0x01:
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	var rest []byte
+	switch fixed[13] {
+	case 0x11, 0x12: // TCP/UDP over IPv4
+		if len(payload) < 12 {
+			return nil, ErrInvalidHeader
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+		rest = payload[12:]
+	case 0x21, 0x22: // TCP/UDP over IPv6
+		if len(payload) < 36 {
+			return nil, ErrInvalidHeader
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+		rest = payload[36:]
+	case 0x31, 0x32: // Unix stream/datagram
+		if len(payload) < 216 {
+			return nil, ErrInvalidHeader
+		}
+		header.Source = &net.UnixAddr{Name: cString(payload[0:108]), Net: "unix"}
+		header.Destination = &net.UnixAddr{Name: cString(payload[108:216]), Net: "unix"}
+		rest = payload[216:]
+	default:
+		// 未知地址族，按协议规定忽略地址信息
+		header.Local = true
+		return header, nil
+	}
+
+	tlvs, err := parseTLVs(rest)
+	if err != nil {
+		return nil, err
+	}
+	header.TLVs = tlvs
+	return header, nil
+}
+
+func parseTLVs(b []byte) ([]TLV, error) {
+	var tlvs []TLV
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, ErrInvalidHeader
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, ErrInvalidHeader
+		}
+		tlvs = append(tlvs, TLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
+
+// TLV 按类型查找扩展字段
+func (h *Header) TLV(t byte) ([]byte, bool) {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value, true
+		}
+	}
+	return nil, false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
@@ -0,0 +1,168 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// v2Header 拼接 PROXY v2 头部，length 为负数时使用 payload 的实际长度
+func v2Header(command, family byte, length int, payload []byte) []byte {
+	if length < 0 {
+		length = len(payload)
+	}
+	b := append([]byte{}, v2Signature...)
+	b = append(b, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:16], uint16(length))
+	return append(b, payload...)
+}
+
+// tlv 拼接一个 TLV 字段，length 为负数时使用 value 的实际长度
+func tlv(typ byte, length int, value string) []byte {
+	if length < 0 {
+		length = len(value)
+	}
+	return append([]byte{typ, byte(length >> 8), byte(length)}, value...)
+}
+
+func tcpAddr(s string) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", s)
+	if err != nil {
+		panic(err)
+	}
+	return addr
+}
+
+func unixAddr(name string) net.Addr {
+	return &net.UnixAddr{Name: name, Net: "unix"}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.Network() + " " + addr.String()
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+var (
+	ipv4Addrs = []byte{192, 0, 2, 1, 198, 51, 100, 1, 0x30, 0x39, 0x01, 0xbb}
+	ipv6Addrs = concat(
+		[]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1},
+		[]byte{0x20, 0x01, 0x0d, 0xb8, 15: 2},
+		[]byte{0x30, 0x39, 0x01, 0xbb},
+	)
+	unixAddrs = concat(append([]byte("/run/src.sock"), make([]byte, 95)...), append([]byte("/run/dst.sock"), make([]byte, 95)...))
+)
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  *Header
+		err   error
+		tlvs  []TLV
+		rest  string
+	}{
+		// v1
+		{name: "v1 tcp4", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\nGET"), want: &Header{Version: 1, Source: tcpAddr("192.0.2.1:12345"), Destination: tcpAddr("198.51.100.1:443")}, rest: "GET"},
+		{name: "v1 tcp6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), want: &Header{Version: 1, Source: tcpAddr("[2001:db8::1]:12345"), Destination: tcpAddr("[2001:db8::2]:443")}},
+		{name: "v1 unknown", input: []byte("PROXY UNKNOWN\r\nGET"), want: &Header{Version: 1, Local: true}, rest: "GET"},
+		{name: "v1 unknown with addresses", input: []byte("PROXY UNKNOWN ffff:f...f ffff:f...f 65535 65535\r\n"), want: &Header{Version: 1, Local: true}},
+		{name: "v1 tcp4 with ipv6 source", input: []byte("PROXY TCP4 2001:db8::1 198.51.100.1 12345 443\r\n"), err: ErrInvalidHeader},
+		{name: "v1 tcp4 with ipv6 destination", input: []byte("PROXY TCP4 192.0.2.1 2001:db8::2 12345 443\r\n"), err: ErrInvalidHeader},
+		{name: "v1 tcp6 with ipv4 source", input: []byte("PROXY TCP6 192.0.2.1 2001:db8::2 12345 443\r\n"), err: ErrInvalidHeader},
+		{name: "v1 tcp6 with ipv4 destination", input: []byte("PROXY TCP6 2001:db8::1 198.51.100.1 12345 443\r\n"), err: ErrInvalidHeader},
+		{name: "v1 unknown protocol", input: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 12345 443\r\n"), err: ErrInvalidHeader},
+		{name: "v1 missing port", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345\r\n"), err: ErrInvalidHeader},
+		{name: "v1 bad address", input: []byte("PROXY TCP4 192.0.2.256 198.51.100.1 12345 443\r\n"), err: ErrInvalidHeader},
+		{name: "v1 port out of range", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"), err: ErrInvalidHeader},
+		{name: "v1 bare newline", input: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\n"), err: ErrInvalidHeader},
+		{name: "v1 too long", input: []byte("PROXY UNKNOWN " + strings.Repeat("x", v1MaxLength) + "\r\n"), err: ErrInvalidHeader},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 192.0.2.1"), err: io.EOF},
+		{name: "not a header", input: []byte("GET / HTTP/1.1\r\n"), err: ErrNoHeader},
+		{name: "empty", input: nil, err: io.EOF},
+
+		// v2
+		{name: "v2 tcp4", input: concat(v2Header(0x1, 0x11, -1, ipv4Addrs), []byte("GET")), want: &Header{Version: 2, Source: tcpAddr("192.0.2.1:12345"), Destination: tcpAddr("198.51.100.1:443")}, rest: "GET"},
+		{name: "v2 tcp6", input: v2Header(0x1, 0x21, -1, ipv6Addrs), want: &Header{Version: 2, Source: tcpAddr("[2001:db8::1]:12345"), Destination: tcpAddr("[2001:db8::2]:443")}},
+		{name: "v2 unix", input: v2Header(0x1, 0x31, -1, unixAddrs), want: &Header{Version: 2, Source: unixAddr("/run/src.sock"), Destination: unixAddr("/run/dst.sock")}},
+		{name: "v2 local", input: concat(v2Header(0x0, 0x00, -1, nil), []byte("GET")), want: &Header{Version: 2, Local: true}, rest: "GET"},
+		{name: "v2 local skips payload", input: concat(v2Header(0x0, 0x11, -1, ipv4Addrs), []byte("GET")), want: &Header{Version: 2, Local: true}, rest: "GET"},
+		{name: "v2 unspec family", input: concat(v2Header(0x1, 0x00, -1, []byte{1, 2, 3}), []byte("GET")), want: &Header{Version: 2, Local: true}, rest: "GET"},
+		{name: "v2 tlvs", input: v2Header(0x1, 0x11, -1, concat(ipv4Addrs, tlv(PP2TypeALPN, -1, "h2"), tlv(PP2TypeNoop, -1, ""), tlv(PP2TypeAuthority, -1, "a.test"))), want: &Header{Version: 2, Source: tcpAddr("192.0.2.1:12345"), Destination: tcpAddr("198.51.100.1:443")},
+			tlvs: []TLV{{PP2TypeALPN, []byte("h2")}, {PP2TypeNoop, []byte{}}, {PP2TypeAuthority, []byte("a.test")}}},
+		{name: "v2 bad version", input: append(append([]byte{}, v2Signature...), 0x11, 0x11, 0, 0), err: ErrInvalidHeader},
+		{name: "v2 bad command", input: v2Header(0x2, 0x11, -1, ipv4Addrs), err: ErrInvalidHeader},
+		{name: "v2 bad signature", input: append([]byte("\r\n\r\n\x00\r\nQUIT\r"), 0x21, 0x11, 0, 0), err: ErrInvalidHeader},
+		{name: "v2 short ipv4 addresses", input: v2Header(0x1, 0x11, -1, ipv4Addrs[:11]), err: ErrInvalidHeader},
+		{name: "v2 short ipv6 addresses", input: v2Header(0x1, 0x21, -1, ipv4Addrs), err: ErrInvalidHeader},
+		{name: "v2 short unix addresses", input: v2Header(0x1, 0x31, -1, ipv6Addrs), err: ErrInvalidHeader},
+		{name: "v2 tlv longer than payload", input: v2Header(0x1, 0x11, -1, concat(ipv4Addrs, tlv(PP2TypeALPN, 3, "h2"))), err: ErrInvalidHeader},
+		{name: "v2 truncated tlv header", input: v2Header(0x1, 0x11, -1, concat(ipv4Addrs, []byte{PP2TypeALPN, 0})), err: ErrInvalidHeader},
+		{name: "v2 truncated signature", input: v2Signature[:8], err: io.ErrUnexpectedEOF},
+		{name: "v2 truncated payload", input: v2Header(0x1, 0x11, 12, ipv4Addrs[:6]), err: io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tt.input))
+			got, err := ReadHeader(r)
+			if err != tt.err {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			if got.Version != tt.want.Version || got.Local != tt.want.Local ||
+				addrString(got.Source) != addrString(tt.want.Source) || addrString(got.Destination) != addrString(tt.want.Destination) {
+				t.Errorf("header = %+v, want %+v", got, tt.want)
+			}
+			if len(got.TLVs) != len(tt.tlvs) {
+				t.Fatalf("tlvs = %v, want %v", got.TLVs, tt.tlvs)
+			}
+			for i, tlv := range tt.tlvs {
+				if got.TLVs[i].Type != tlv.Type || !bytes.Equal(got.TLVs[i].Value, tlv.Value) {
+					t.Errorf("tlv %d = %v, want %v", i, got.TLVs[i], tlv)
+				}
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != tt.rest {
+				t.Errorf("rest = %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestParseTLVs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		count int
+		ok    bool
+	}{
+		{name: "empty", input: nil, ok: true},
+		{name: "one", input: tlv(PP2TypeUniqueID, -1, "id"), count: 1, ok: true},
+		{name: "zero length", input: tlv(PP2TypeNoop, 0, ""), count: 1, ok: true},
+		{name: "two", input: concat(tlv(PP2TypeALPN, -1, "h2"), tlv(PP2TypeSSL, -1, "\x01\x00\x00\x00\x00")), count: 2, ok: true},
+		{name: "one byte", input: []byte{PP2TypeALPN}},
+		{name: "two bytes", input: []byte{PP2TypeALPN, 0}},
+		{name: "length past end", input: tlv(PP2TypeALPN, 3, "h2")},
+		{name: "trailing garbage", input: concat(tlv(PP2TypeALPN, -1, "h2"), []byte{0})},
+		{name: "max length", input: tlv(PP2TypeALPN, 0xffff, "h2")},
+	}
+	for _, tt := range tests {
+		tlvs, err := parseTLVs(tt.input)
+		if tt.ok != (err == nil) || len(tlvs) != tt.count {
+			t.Errorf("%s: parseTLVs = %v, %v, want %d TLVs, ok=%v", tt.name, tlvs, err, tt.count, tt.ok)
+		}
+		if !tt.ok && err != ErrInvalidHeader {
+			t.Errorf("%s: err = %v, want ErrInvalidHeader", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/logger"
+)
+
+// accessQueue 每个访问日志文件等待写入的最大条目数，超出时丢弃
+const accessQueue = 4096
+
+// accessRecord 存储一次请求的访问日志数据
+type accessRecord struct {
+	Listener *config.Listener
+	Vhost    *config.Vhost
+	Req      *Request
+	Res      *Response
+	Sent     int
+	End      time.Time
+}
+
+// accessWriter 在后台批量写入同一个访问日志文件
+type accessWriter struct {
+	path     string
+	buffer   int
+	interval time.Duration
+	rotate   logger.RotateOptions
+	lines    chan []byte
+	quit     chan struct{}
+	done     chan struct{}
+	dropped  uint64
+}
+
+// accessLogger 按路径管理访问日志文件，多个虚拟主机可以共用同一个文件
+type accessLogger struct {
+	mutex   sync.RWMutex
+	writers map[string]*accessWriter
+}
+
+var accessLogs = &accessLogger{writers: make(map[string]*accessWriter)}
+
+// configure 打开新配置中的访问日志文件，关闭不再使用的文件
+func (a *accessLogger) configure(logs []*config.AccessLog) {
+	wanted := make(map[string]*config.AccessLog)
+	for _, l := range logs {
+		if _, ok := wanted[l.Path]; !ok {
+			wanted[l.Path] = l
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for p, w := range a.writers {
+		l, ok := wanted[p]
+		if !ok || w.buffer != l.Buffer || w.interval != time.Duration(l.Flush)*time.Second || w.rotate != rotateOptions(l.Rotate) {
+			w.close()
+			delete(a.writers, p)
+		}
+	}
+	for p, l := range wanted {
+		if _, ok := a.writers[p]; ok {
+			continue
+		}
+		w, err := openAccessWriter(l)
+		if err != nil {
+			logger.Error.Println("access log:", err)
+			continue
+		}
+		a.writers[p] = w
+	}
+}
+
+// close 写入剩余的日志并关闭所有文件
+func (a *accessLogger) close() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for p, w := range a.writers {
+		w.close()
+		delete(a.writers, p)
+	}
+}
+
+// log 格式化访问日志并交给后台写入，队列已满时丢弃
+func (a *accessLogger) log(l *config.AccessLog, rec *accessRecord) {
+	if l.Disabled() || l.Skipped(rec.Res.Code, rec.Req.Method, rec.Req.File, net.ParseIP(rec.Req.ClientIP())) {
+		return
+	}
+	line := rec.format(l)
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	w := a.writers[l.Path]
+	if w == nil {
+		return
+	}
+	select {
+	case w.lines <- line:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+func openAccessWriter(l *config.AccessLog) (*accessWriter, error) {
+	var out io.Writer
+	var file *logger.File
+	switch l.Path {
+	case "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		var err error
+		file, err = logger.OpenFile(l.Path, rotateOptions(l.Rotate))
+		if err != nil {
+			return nil, err
+		}
+		out = file
+	}
+
+	w := &accessWriter{
+		path:     l.Path,
+		buffer:   l.Buffer,
+		interval: time.Duration(l.Flush) * time.Second,
+		rotate:   rotateOptions(l.Rotate),
+		lines:    make(chan []byte, accessQueue),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run(out, file)
+	return w, nil
+}
+
+func (w *accessWriter) run(out io.Writer, file *logger.File) {
+	defer close(w.done)
+	buf := bufio.NewWriterSize(out, w.buffer)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case line := <-w.lines:
+			buf.Write(line)
+		case <-ticker.C:
+			w.flush(buf, out)
+		case <-w.quit:
+			// 只有当前 goroutine 读取队列，可以按长度取出剩余的日志
+			for len(w.lines) > 0 {
+				buf.Write(<-w.lines)
+			}
+			w.flush(buf, out)
+			if file != nil {
+				file.Close()
+			}
+			return
+		}
+	}
+}
+
+func (w *accessWriter) flush(buf *bufio.Writer, out io.Writer) {
+	if err := buf.Flush(); err != nil {
+		logger.Error.Println("access log "+w.path+":", err)
+		buf.Reset(out)
+	}
+	if n := atomic.SwapUint64(&w.dropped, 0); n > 0 {
+		logger.Warning.Println("access log "+w.path+": queue full, dropped", n, "entries")
+	}
+}
+
+func (w *accessWriter) close() {
+	close(w.quit)
+	<-w.done
+}
+
+// format 按照配置的格式生成一行访问日志
+func (rec *accessRecord) format(l *config.AccessLog) []byte {
+	if l.Format == "json" {
+		return rec.json()
+	}
+	var line bytes.Buffer
+	for _, token := range l.Tokens {
+		if token.Var == "" {
+			line.WriteString(token.Literal)
+			continue
+		}
+		value := rec.variable(token.Var)
+		if value == "" {
+			value = "-"
+		}
+		line.WriteString(escapeLogValue(value))
+	}
+	line.WriteByte('\n')
+	return line.Bytes()
+}
+
+// variable 返回模板变量的值
+func (rec *accessRecord) variable(name string) string {
+	req, resp := rec.Req, rec.Res
+	switch name {
+	case "remote_addr":
+		return req.ClientIP()
+	case "remote_port":
+		return req.ClientPort()
+	case "peer_addr":
+		return req.PeerIP()
+	case "remote_user":
+		return basicUser(req)
+	case "time_local":
+		return rec.End.Format("02/Jan/2006:15:04:05 -0700")
+	case "time_iso8601":
+		return rec.End.Format(time.RFC3339)
+	case "msec":
+		return strconv.FormatFloat(float64(rec.End.UnixNano()/int64(time.Millisecond))/1000, 'f', 3, 64)
+	case "request":
+		return req.Method + " " + req.RequestURI + " " + req.Proto
+	case "request_method":
+		return req.Method
+	case "request_uri":
+		return req.RequestURI
+	case "uri":
+		return req.File
+	case "args":
+		return req.Querys
+	case "server_protocol":
+		return req.Proto
+	case "status":
+		return strconv.Itoa(resp.Code)
+	case "body_bytes_sent":
+		return strconv.Itoa(resp.Length())
+	case "bytes_sent":
+		return strconv.Itoa(rec.Sent)
+	case "request_length":
+		return strconv.Itoa(rec.requestLength())
+	case "request_time":
+		return strconv.FormatFloat(rec.duration().Seconds(), 'f', 3, 64)
+	case "host":
+		return req.Host
+	case "server_port":
+		return rec.Listener.Port
+	case "vhost":
+		if rec.Vhost == nil {
+			return ""
+		}
+		return vhostName(rec.Vhost)
+	case "listener":
+		return rec.Listener.Name
+	case "request_id":
+		return req.RequestID
+	case "scheme":
+		if req.TLS {
+			return "https"
+		}
+		return "http"
+	}
+
+	switch {
+	case strings.HasPrefix(name, "sent_http_"):
+		return resp.HeaderValue(strings.Replace(name[10:], "_", "-", -1))
+	case strings.HasPrefix(name, "http_"):
+		return strings.Join(req.HeaderValues(strings.Replace(name[5:], "_", "-", -1)), ", ")
+	case strings.HasPrefix(name, "cookie_"):
+		return req.Cookies()[name[7:]]
+	case strings.HasPrefix(name, "arg_"):
+		query, _ := url.ParseQuery(req.Querys)
+		return query.Get(name[4:])
+	}
+	return ""
+}
+
+// accessJSON 是 JSON 格式的访问日志
+type accessJSON struct {
+	Time         string  `json:"time"`
+	RequestID    string  `json:"request_id"`
+	Client       string  `json:"client"`
+	Method       string  `json:"method"`
+	URI          string  `json:"uri"`
+	Protocol     string  `json:"protocol"`
+	Status       int     `json:"status"`
+	Bytes        int     `json:"bytes"`
+	BytesSent    int     `json:"bytes_sent"`
+	RequestBytes int     `json:"request_bytes"`
+	Duration     float64 `json:"duration_ms"`
+	Host         string  `json:"host"`
+	Vhost        string  `json:"vhost,omitempty"`
+	Listener     string  `json:"listener"`
+	Scheme       string  `json:"scheme"`
+	User         string  `json:"user,omitempty"`
+	Referer      string  `json:"referer,omitempty"`
+	UserAgent    string  `json:"user_agent,omitempty"`
+}
+
+func (rec *accessRecord) json() []byte {
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	enc.Encode(accessJSON{
+		Time:         rec.End.Format("2006-01-02T15:04:05.000Z07:00"),
+		RequestID:    rec.Req.RequestID,
+		Client:       rec.Req.ClientIP(),
+		Method:       rec.Req.Method,
+		URI:          rec.Req.RequestURI,
+		Protocol:     rec.Req.Proto,
+		Status:       rec.Res.Code,
+		Bytes:        rec.Res.Length(),
+		BytesSent:    rec.Sent,
+		RequestBytes: rec.requestLength(),
+		Duration:     float64(rec.duration()/time.Microsecond) / 1000,
+		Host:         rec.Req.Host,
+		Vhost:        rec.variable("vhost"),
+		Listener:     rec.Listener.Name,
+		Scheme:       rec.variable("scheme"),
+		User:         basicUser(rec.Req),
+		Referer:      rec.variable("http_referer"),
+		UserAgent:    rec.variable("http_user_agent"),
+	})
+	return line.Bytes()
+}
+
+func (rec *accessRecord) duration() time.Duration {
+	if rec.Req.Start.IsZero() {
+		return 0
+	}
+	return rec.End.Sub(rec.Req.Start)
+}
+
+// requestLength 返回请求行、头部和内容的总长度
+func (rec *accessRecord) requestLength() int {
+	n := len(rec.Req.Body)
+	for _, line := range rec.Req.Headers {
+		n += len(line) + 2
+	}
+	return n
+}
+
+// basicUser 返回 Basic 认证中的用户名
+func basicUser(req *Request) string {
+	for _, value := range req.HeaderValues("Authorization") {
+		fields := strings.Fields(value)
+		if len(fields) != 2 || !strings.EqualFold(fields[0], "Basic") {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			continue
+		}
+		return strings.SplitN(string(decoded), ":", 2)[0]
+	}
+	return ""
+}
+
+// escapeLogValue 将控制字符、非 ASCII 字符、引号和反斜杠转义为 \xHH，防止伪造日志行
+func escapeLogValue(value string) string {
+	const hex = "0123456789ABCDEF"
+	var escaped []byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 0x20 && c < 0x7f && c != '"' && c != '\\' {
+			if escaped != nil {
+				escaped = append(escaped, c)
+			}
+			continue
+		}
+		if escaped == nil {
+			escaped = append(escaped, value[:i]...)
+		}
+		escaped = append(escaped, '\\', 'x', hex[c>>4], hex[c&0xf])
+	}
+	if escaped == nil {
+		return value
+	}
+	return string(escaped)
+}
+
+// LogOptions 将服务器日志的配置转换为 logger 的设置
+func LogOptions(conf config.Log) logger.Options {
+	opts := logger.Options{Level: conf.Level, Format: conf.Format}
+	for _, out := range conf.Outputs {
+		opts.Outputs = append(opts.Outputs, logger.OutputOptions{
+			Path:   out.Path,
+			Level:  out.Level,
+			Format: out.Format,
+			Rotate: rotateOptions(out.Rotate),
+		})
+	}
+	return opts
+}
+
+func rotateOptions(r config.Rotate) logger.RotateOptions {
+	return logger.RotateOptions{MaxSize: r.MaxSize, Interval: r.Interval, Keep: r.Keep, Compress: r.Compress}
+}
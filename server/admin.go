@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/logger"
+)
+
+// adminEntry 是管理接口中的缓存条目，Age 和 TTL 以秒为单位，TTL 为负数时条目已过期
+type adminEntry struct {
+	Key     string            `json:"key"`
+	URL     string            `json:"url"`
+	Vhost   string            `json:"vhost"`
+	Code    int               `json:"code"`
+	Size    int64             `json:"size"`
+	Age     int64             `json:"age"`
+	TTL     int64             `json:"ttl"`
+	Stored  time.Time         `json:"stored"`
+	Expires time.Time         `json:"expires"`
+	Tags    []string          `json:"tags"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// AdminHandler 处理管理接口的请求：查看和清除响应缓存，查看和修改日志级别
+func AdminHandler(conf config.Admin, req *Request) *Response {
+	if conf.Token != "" && !adminAuthorized(conf.Token, req) {
+		resp := adminResponse(401, map[string]string{"error": "unauthorized"})
+		resp.Header("WWW-Authenticate: Bearer")
+		return resp
+	}
+
+	query, err := url.ParseQuery(req.Querys)
+	if err != nil {
+		return adminResponse(400, map[string]string{"error": err.Error()})
+	}
+	if req.Method == "POST" {
+		form, err := url.ParseQuery(req.Body)
+		if err != nil {
+			return adminResponse(400, map[string]string{"error": err.Error()})
+		}
+		for k, v := range form {
+			query[k] = append(query[k], v...)
+		}
+	}
+	filter := cacheFilter{
+		Key:    query.Get("key"),
+		Prefix: query.Get("prefix"),
+		Vhost:  query.Get("vhost"),
+		Tag:    query.Get("tag"),
+	}
+
+	switch req.File {
+	case "/cache/stats":
+		if req.Method != "GET" && req.Method != "HEAD" {
+			return adminMethodNotAllowed("GET, HEAD")
+		}
+		return adminResponse(200, ResponseCache())
+	case "/cache/entries":
+		if req.Method != "GET" && req.Method != "HEAD" {
+			return adminMethodNotAllowed("GET, HEAD")
+		}
+		now := time.Now()
+		list := []adminEntry{}
+		for _, entry := range responses.list(filter) {
+			list = append(list, newAdminEntry(&entry, now, false))
+		}
+		return adminResponse(200, list)
+	case "/cache/entry":
+		if req.Method != "GET" && req.Method != "HEAD" {
+			return adminMethodNotAllowed("GET, HEAD")
+		}
+		if filter.Key == "" {
+			return adminResponse(400, map[string]string{"error": "key is required"})
+		}
+		entries := responses.list(cacheFilter{Key: filter.Key})
+		if len(entries) == 0 {
+			return adminResponse(404, map[string]string{"error": "no such entry"})
+		}
+		return adminResponse(200, newAdminEntry(&entries[0], time.Now(), true))
+	case "/cache/purge":
+		if req.Method != "POST" {
+			return adminMethodNotAllowed("POST")
+		}
+		// 没有任何条件时必须显式指定 all，避免误删整个缓存
+		if filter.empty() && query.Get("all") != "1" && query.Get("all") != "true" {
+			return adminResponse(400, map[string]string{"error": "one of key, prefix, vhost, tag or all is required"})
+		}
+		return adminResponse(200, map[string]int{"purged": responses.purge(filter)})
+	case "/log/level":
+		switch req.Method {
+		case "GET", "HEAD":
+		case "POST":
+			level, err := logger.ParseLevel(query.Get("level"))
+			if err != nil {
+				return adminResponse(400, map[string]string{"error": err.Error()})
+			}
+			logger.SetLevel(level)
+			logger.Info.Log("log level changed", "level", level)
+		default:
+			return adminMethodNotAllowed("GET, HEAD, POST")
+		}
+		return adminResponse(200, map[string]string{"level": logger.GetLevel().String()})
+	}
+	return adminResponse(404, map[string]string{"error": "not found"})
+}
+
+// adminAuthorized 校验 Authorization 头部中的 Bearer 令牌
+func adminAuthorized(token string, req *Request) bool {
+	for _, value := range req.HeaderValues("Authorization") {
+		fields := strings.Fields(value)
+		if len(fields) == 2 && strings.EqualFold(fields[0], "Bearer") &&
+			subtle.ConstantTimeCompare([]byte(fields[1]), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func newAdminEntry(entry *cacheEntry, now time.Time, headers bool) adminEntry {
+	info := adminEntry{
+		Key:     entry.Key,
+		URL:     entry.URL,
+		Vhost:   entry.Vhost,
+		Code:    entry.Code,
+		Size:    entry.Size,
+		Age:     int64(now.Sub(entry.Stored) / time.Second),
+		TTL:     int64(entry.Expires.Sub(now) / time.Second),
+		Stored:  entry.Stored,
+		Expires: entry.Expires,
+		Tags:    entry.Tags,
+	}
+	if info.Tags == nil {
+		info.Tags = []string{}
+	}
+	if headers {
+		info.Headers = entry.Headers
+	}
+	return info
+}
+
+func adminMethodNotAllowed(allow string) *Response {
+	resp := adminResponse(405, map[string]string{"error": "method not allowed"})
+	resp.Header("Allow: " + allow)
+	return resp
+}
+
+func adminResponse(code int, v interface{}) *Response {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return ErrorResponse(500, "Internal Server Error")
+	}
+	resp := &Response{Code: code, Content: string(content) + "\n"}
+	resp.Header("Content-Type: application/json")
+	resp.Header("Cache-Control: no-store")
+	return resp
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+)
+
+// assetSource 记录静态响应对应的文件，用于缓存压缩结果
+type assetSource struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+type assetKey struct {
+	source   assetSource
+	encoding string
+}
+
+type assetEntry struct {
+	key     assetKey
+	content []byte
+}
+
+// assetCache 按路径、修改时间、大小和编码缓存静态文件压缩后的内容，超过容量时淘汰最久未使用的条目
+type assetCache struct {
+	mutex        sync.Mutex
+	disabled     bool
+	maxSize      int64
+	maxEntrySize int64
+	size         int64
+	lru          *list.List
+	entries      map[assetKey]*list.Element
+	versions     map[string]map[assetKey]struct{}
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// AssetCacheStats 存储压缩缓存的统计信息
+type AssetCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Size      int64
+	MaxSize   int64
+}
+
+var assets = &assetCache{
+	lru:      list.New(),
+	entries:  make(map[assetKey]*list.Element),
+	versions: make(map[string]map[assetKey]struct{}),
+}
+
+// AssetCache 返回压缩缓存的统计信息
+func AssetCache() AssetCacheStats {
+	assets.mutex.Lock()
+	defer assets.mutex.Unlock()
+	return AssetCacheStats{
+		Hits:      atomic.LoadUint64(&assets.hits),
+		Misses:    atomic.LoadUint64(&assets.misses),
+		Evictions: atomic.LoadUint64(&assets.evictions),
+		Entries:   assets.lru.Len(),
+		Size:      assets.size,
+		MaxSize:   assets.maxSize,
+	}
+}
+
+// configure 应用新的缓存配置，容量缩小时立即淘汰多余的条目
+func (c *assetCache) configure(conf config.AssetCache) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.disabled = conf.Disable
+	c.maxSize = conf.MaxSize
+	c.maxEntrySize = conf.MaxEntrySize
+	if c.disabled {
+		c.maxSize = 0
+	}
+	c.evictLocked()
+}
+
+// encode 返回压缩后的内容，命中缓存时直接返回缓存的结果
+func (c *assetCache) encode(source *assetSource, encoding string, content []byte) ([]byte, error) {
+	c.mutex.Lock()
+	cacheable := !c.disabled && source.size <= c.maxEntrySize
+	key := assetKey{source: *source, encoding: encoding}
+	if cacheable {
+		if el, ok := c.entries[key]; ok {
+			c.lru.MoveToFront(el)
+			c.mutex.Unlock()
+			atomic.AddUint64(&c.hits, 1)
+			return el.Value.(*assetEntry).content, nil
+		}
+	}
+	c.mutex.Unlock()
+
+	encoded, err := encodeContent(encoding, content)
+	if err != nil || !cacheable {
+		return encoded, err
+	}
+	atomic.AddUint64(&c.misses, 1)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// 文件发生变化后，同一路径下旧版本的条目不会再被命中
+	for old := range c.versions[source.path] {
+		if old.source != key.source {
+			c.removeLocked(c.entries[old])
+		}
+	}
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.lru.PushFront(&assetEntry{key: key, content: encoded})
+		if c.versions[source.path] == nil {
+			c.versions[source.path] = make(map[assetKey]struct{})
+		}
+		c.versions[source.path][key] = struct{}{}
+		c.size += int64(len(encoded))
+		c.evictLocked()
+	}
+	return encoded, nil
+}
+
+func (c *assetCache) evictLocked() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+func (c *assetCache) removeLocked(el *list.Element) {
+	entry := c.lru.Remove(el).(*assetEntry)
+	delete(c.entries, entry.key)
+	delete(c.versions[entry.key.source.path], entry.key)
+	if len(c.versions[entry.key.source.path]) == 0 {
+		delete(c.versions, entry.key.source.path)
+	}
+	c.size -= int64(len(entry.content))
+}
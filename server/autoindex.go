@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kotoyuuko/bronya/logger"
+)
+
+// dirEntry 目录列表中的一项
+type dirEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	MTime string `json:"mtime"`
+
+	modTime time.Time
+}
+
+// autoindex 生成目录列表，格式由 format 参数、Accept 头部或虚拟主机配置决定
+func (ctx *Context) autoindex(dir string) *Response {
+	root, err := filepath.EvalSymlinks(ctx.Vhost.Root)
+	if err != nil {
+		logger.Error.Println(err)
+		return ErrorResponse(500, "Internal Server Error")
+	}
+	real, _, err := ctx.resolve(dir)
+	if err != nil {
+		return pathError(dir, err)
+	}
+
+	infos, err := ioutil.ReadDir(real)
+	if err != nil {
+		logger.Warning.Println(err)
+		return ErrorResponse(403, "Forbidden")
+	}
+
+	var entries []*dirEntry
+	for _, fi := range infos {
+		if !ctx.Vhost.Autoindex.Hidden && strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if htaccessFile(fi.Name()) || ctx.Vhost.Deny.Denied(dir+fi.Name()) {
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := ctx.followLink(root, filepath.Join(real, fi.Name()), fi)
+			if err != nil {
+				continue
+			}
+			name := fi.Name()
+			if fi, err = os.Stat(target); err != nil {
+				continue
+			}
+			entries = appendEntry(entries, name, fi)
+			continue
+		}
+		entries = appendEntry(entries, fi.Name(), fi)
+	}
+
+	query, _ := url.ParseQuery(ctx.Req.Querys)
+	sortBy, order := query.Get("sort"), query.Get("order")
+	sortEntries(entries, sortBy, order == "desc")
+
+	response := &Response{Code: 200}
+	switch ctx.listFormat(query.Get("format")) {
+	case "json":
+		if entries == nil {
+			entries = []*dirEntry{}
+		}
+		content, err := json.Marshal(entries)
+		if err != nil {
+			logger.Error.Println(err)
+			return ErrorResponse(500, "Internal Server Error")
+		}
+		response.Header("Content-Type: application/json")
+		response.Content = string(content)
+	case "plain":
+		var sb strings.Builder
+		for _, entry := range entries {
+			name := entry.Name
+			if entry.Type == "directory" {
+				name += "/"
+			}
+			sb.WriteString(name + "\t" + strconv.FormatInt(entry.Size, 10) + "\t" + entry.MTime + "\n")
+		}
+		response.Header("Content-Type: text/plain; charset=utf-8")
+		response.Content = sb.String()
+	default:
+		response.Header("Content-Type: text/html; charset=utf-8")
+		response.Content = renderListing(dir, entries, sortBy, order)
+	}
+	return response
+}
+
+func appendEntry(entries []*dirEntry, name string, fi os.FileInfo) []*dirEntry {
+	entry := &dirEntry{Name: name, Type: "file", Size: fi.Size(), modTime: fi.ModTime()}
+	switch {
+	case fi.IsDir():
+		entry.Type, entry.Size = "directory", 0
+	case !fi.Mode().IsRegular():
+		return entries
+	}
+	entry.MTime = entry.modTime.UTC().Format(time.RFC3339)
+	return append(entries, entry)
+}
+
+// listFormat 选择目录列表的输出格式
+func (ctx *Context) listFormat(format string) string {
+	switch format {
+	case "html", "json", "plain":
+		return format
+	}
+	for _, accept := range ctx.Req.HeaderValues("Accept") {
+		switch {
+		case strings.HasPrefix(accept, "application/json"):
+			return "json"
+		case strings.HasPrefix(accept, "text/plain"):
+			return "plain"
+		}
+	}
+	if ctx.Vhost.Autoindex.Format != "" {
+		return ctx.Vhost.Autoindex.Format
+	}
+	return "html"
+}
+
+// sortEntries 排序目录列表，目录始终排在文件前面
+func sortEntries(entries []*dirEntry, by string, desc bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Type != b.Type {
+			return a.Type == "directory"
+		}
+		if desc {
+			a, b = b, a
+		}
+		switch by {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.modTime.Equal(b.modTime) {
+				return a.modTime.Before(b.modTime)
+			}
+		}
+		return a.Name < b.Name
+	})
+}
+
+func renderListing(dir string, entries []*dirEntry, sortBy, order string) string {
+	title := html.EscapeString(dir)
+
+	column := func(name, label string) string {
+		next := "asc"
+		if (sortBy == name || sortBy == "" && name == "name") && order != "desc" {
+			next = "desc"
+		}
+		return `<th><a href="?sort=` + name + `&amp;order=` + next + `">` + label + `</a></th>`
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Index of " + title + "</title></head>\n")
+	sb.WriteString("<body><h1>Index of " + title + "</h1>\n<table>\n<tr>")
+	sb.WriteString(column("name", "Name") + column("mtime", "Last modified") + column("size", "Size"))
+	sb.WriteString("</tr>\n")
+	if dir != "/" {
+		sb.WriteString("<tr><td><a href=\"../\">../</a></td><td></td><td>-</td></tr>\n")
+	}
+	for _, entry := range entries {
+		name, href, size := entry.Name, "./"+url.PathEscape(entry.Name), humanSize(entry.Size)
+		if entry.Type == "directory" {
+			name, href, size = name+"/", href+"/", "-"
+		}
+		sb.WriteString("<tr><td><a href=\"" + html.EscapeString(href) + "\">" + html.EscapeString(name) + "</a></td>")
+		sb.WriteString("<td>" + entry.modTime.Format("2006-01-02 15:04") + "</td><td>" + size + "</td></tr>\n")
+	}
+	sb.WriteString("</table>\n<hr><address>Bronya/" + Version + "</address></body></html>\n")
+	return sb.String()
+}
+
+// humanSize 将字节数转换为便于阅读的形式
+func humanSize(size int64) string {
+	if size < 1024 {
+		return strconv.FormatInt(size, 10)
+	}
+	value, units := float64(size), "KMGTP"
+	i := -1
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + units[i:i+1]
+}
+
+// within 判断 path 是否位于 root 目录之内
+func within(root, path string) bool {
+	if root == string(filepath.Separator) || path == root {
+		return true
+	}
+	return strings.HasPrefix(path, root+string(filepath.Separator))
+}
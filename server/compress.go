@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/kotoyuuko/bronya/logger"
+)
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// compress 按照虚拟主机配置与 Accept-Encoding 压缩响应内容，
+// 已经带有 Content-Encoding 的响应（如 FastCGI 自行压缩的内容）不会被再次压缩
+func (ctx *Context) compress(resp *Response) *Response {
+	if resp.Code != 200 || resp.HeaderValue("Content-Encoding") != "" {
+		return resp
+	}
+	if !ctx.Vhost.Compression.Compressible(resp.HeaderValue("Content-Type"), resp.Length()) {
+		return resp
+	}
+
+	resp.AddVary("Accept-Encoding")
+	encoding := negotiateEncoding(ctx.Req.HeaderValues("Accept-Encoding"), ctx.Vhost.Compression.Encodings)
+	switch encoding {
+	case "":
+		notAcceptable := ErrorResponse(406, "Not Acceptable")
+		notAcceptable.AddVary("Accept-Encoding")
+		return notAcceptable
+	case "identity":
+		return resp
+	}
+
+	length := resp.Length()
+	if err := resp.Encode(encoding); err != nil {
+		logger.Warning.Println(err)
+		return resp
+	}
+	metrics.observeCompression(encoding, length, resp.Length())
+	return resp
+}
+
+// negotiateEncoding 按照 Accept-Encoding 的 q 值在支持的编码中选择一个，q 值相同时按服务器的优先级，
+// 返回 identity 表示不压缩，返回空字符串表示客户端不接受任何可用的编码
+func negotiateEncoding(values []string, supported []string) string {
+	if len(values) == 0 {
+		return "identity"
+	}
+
+	weights := make(map[string]float64)
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			params := strings.Split(item, ";")
+			name := strings.ToLower(strings.TrimSpace(params[0]))
+			if name == "" {
+				continue
+			}
+			if name == "x-gzip" {
+				name = "gzip"
+			}
+			weight := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if len(param) > 2 && strings.EqualFold(param[:2], "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						weight = q
+					}
+				}
+			}
+			weights[name] = weight
+		}
+	}
+	weight := func(name string) (float64, bool) {
+		if q, ok := weights[name]; ok {
+			return q, true
+		}
+		q, ok := weights["*"]
+		return q, ok
+	}
+
+	best, bestWeight := "", 0.0
+	for _, encoding := range supported {
+		if q, ok := weight(encoding); ok && q > bestWeight {
+			best, bestWeight = encoding, q
+		}
+	}
+
+	identity, listed := weights["identity"]
+	if !listed {
+		identity, listed = weights["*"]
+		if !listed {
+			identity = 1
+		}
+	}
+	switch {
+	case best != "" && (!listed || bestWeight >= identity):
+		return best
+	case identity > 0:
+		return "identity"
+	}
+	return ""
+}
+
+// encodeContent 使用指定的算法压缩内容
+func encodeContent(encoding string, content []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	switch encoding {
+	case "gzip":
+		w := gzip.NewWriter(&buffer)
+		w.Write(content)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "deflate":
+		w := zlib.NewWriter(&buffer)
+		w.Write(content)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "br":
+		w := brotli.NewWriterLevel(&buffer, brotli.DefaultCompression)
+		w.Write(content)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "zstd":
+		return zstdEncoder.EncodeAll(content, nil), nil
+	default:
+		return nil, errors.New("unsupported encoding " + encoding)
+	}
+	return buffer.Bytes(), nil
+}
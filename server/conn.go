@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+)
+
+// 连接状态
+const (
+	stateNew int32 = iota
+	stateReading
+	stateActive
+	stateIdle
+	stateCount
+)
+
+// connStates 各状态的连接数
+var connStates [stateCount]int64
+
+type conn struct {
+	net.Conn
+	ln       *config.Listener
+	state    int32
+	draining int32
+}
+
+func (c *conn) setState(state int32) {
+	old := atomic.SwapInt32(&c.state, state)
+	atomic.AddInt64(&connStates[old], -1)
+	atomic.AddInt64(&connStates[state], 1)
+}
+
+// opened 和 closed 在连接开始和结束处理时调用，用于统计各状态的连接数
+func (c *conn) opened() {
+	atomic.AddInt64(&connStates[c.getState()], 1)
+}
+
+func (c *conn) closed() {
+	atomic.AddInt64(&connStates[c.getState()], -1)
+}
+
+func (c *conn) getState() int32 {
+	return atomic.LoadInt32(&c.state)
+}
+
+// drain 在关闭服务器时缩短读取超时，只在第一次调用时生效
+func (c *conn) drain(deadline time.Time) {
+	if atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+		c.SetReadDeadline(deadline)
+	}
+}
+
+// listener 在重新加载配置时可以替换所属监听器配置
+type listener struct {
+	net.Listener
+	raw    net.Listener
+	ln     atomic.Value
+	closed int32
+}
+
+func (l *listener) conf() *config.Listener {
+	return l.ln.Load().(*config.Listener)
+}
+
+func (l *listener) setConf(ln *config.Listener) {
+	l.ln.Store(ln)
+}
+
+func (l *listener) Close() error {
+	atomic.StoreInt32(&l.closed, 1)
+	return l.Listener.Close()
+}
+
+func (l *listener) isClosed() bool {
+	return atomic.LoadInt32(&l.closed) == 1
+}
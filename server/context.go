@@ -5,7 +5,6 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"strings"
 
@@ -16,116 +15,243 @@ import (
 
 // Context 负责 channel 间通信
 type Context struct {
-	Vhost *config.Vhost
-	Req   *Request
-	Res   chan interface{}
-	Err   chan error
+	Vhost    *config.Vhost
+	Listener *config.Listener
+	Req      *Request
+	Res      chan interface{}
+	Err      chan error
+
+	index   []string
+	listing bool
 }
 
 // Exec 处理请求
 func (ctx *Context) Exec() {
-	var files []string
-	if ctx.Req.File != "/" {
-		files = append(files, ctx.Req.File)
-	} else {
-		for _, index := range ctx.Vhost.Index {
-			files = append(files, "/"+index)
+	ctx.Res <- ctx.compress(ctx.serve())
+}
+
+// serve 生成请求的响应
+func (ctx *Context) serve() *Response {
+	file, err := cleanPath(ctx.Req.File)
+	if err != nil {
+		ctx.log().Warn("rejected request path", "uri", ctx.Req.RequestURI)
+		return ErrorResponse(400, "Bad Request")
+	}
+	ctx.Req.File = file
+
+	if ctx.Vhost.Status.Path != "" && file == ctx.Vhost.Status.Path {
+		return ctx.serverStatus()
+	}
+
+	ctx.index = ctx.Vhost.Index
+	ctx.listing = ctx.Vhost.Autoindex.Enable
+
+	if !ctx.Vhost.Htaccess {
+		return ctx.serveFile()
+	}
+
+	ht, resp := ctx.applyHtaccess()
+	if resp == nil {
+		resp = ctx.serveFile()
+	}
+	if ht != nil {
+		resp = ht.finish(ctx, resp)
+	}
+	return resp
+}
+
+// serveFile 按照请求路径查找文件并生成响应，目录请求依次尝试索引文件和目录列表
+func (ctx *Context) serveFile() *Response {
+	file := ctx.Req.File
+	if ctx.Vhost.Deny.Denied(file) {
+		return ctx.denied()
+	}
+	real, fi, err := ctx.resolve(file)
+	if err != nil {
+		return pathError(file, err)
+	}
+	if !fi.IsDir() {
+		return ctx.serveRegular(file, real)
+	}
+
+	if !strings.HasSuffix(file, "/") {
+		location := escapePath(file + "/")
+		if ctx.Req.Querys != "" {
+			location += "?" + ctx.Req.Querys
 		}
+		return RedirectResponse(301, location)
 	}
-	for _, file := range files {
-		if pathExist(ctx.Vhost.Root+file) && !isDir(ctx.Vhost.Root+file) {
-			response := &Response{
-				Code: 200,
-			}
-
-			if strings.HasSuffix(file, ".php") {
-				env := make(map[string]string)
-				env["SCRIPT_FILENAME"] = ctx.Vhost.Root + file
-				env["SERVER_SOFTWARE"] = "Bronya/1.0.0"
-				env["REMOTE_ADDR"] = "127.0.0.1"
-				env["QUERY_STRING"] = ctx.Req.Querys
-
-				fcgi, err := fcgi.Dial(ctx.Vhost.Fastcgi.Network, ctx.Vhost.Fastcgi.Address)
-				if err != nil {
-					logger.Error.Println(err)
-					ctx.Res <- ErrorResponse(502, "Bad Gateway")
-					break
-				}
-
-				var resp *http.Response
-
-				if ctx.Req.Method == "POST" {
-					querys, err := url.ParseQuery(ctx.Req.Body)
-					if err != nil {
-						logger.Error.Println(err)
-						ctx.Res <- ErrorResponse(500, "Internal Server Error")
-						break
-					}
-
-					resp, err = fcgi.PostForm(env, querys)
-					if err != nil {
-						logger.Error.Println(err)
-						ctx.Res <- ErrorResponse(502, "Bad Gateway")
-						break
-					}
-				} else {
-					resp, err = fcgi.Get(env)
-					if err != nil {
-						logger.Error.Println(err)
-						ctx.Res <- ErrorResponse(502, "Bad Gateway")
-						break
-					}
-				}
-
-				for k, val := range resp.Header {
-					for _, v := range val {
-						response.Header(k + ": " + v)
-					}
-				}
-
-				content, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					logger.Error.Println(err)
-					ctx.Res <- ErrorResponse(502, "Bad Gateway")
-					break
-				}
-
-				response.Content = string(content)
-			} else {
-				fileContent, err := ioutil.ReadFile(ctx.Vhost.Root + file)
-				if err != nil {
-					logger.Warning.Println(err)
-					ctx.Res <- ErrorResponse(500, "Internal Server Error")
-					break
-				}
-
-				response.Header("Content-Type: " + mime.TypeByExtension(path.Ext(ctx.Vhost.Root+file)))
-				response.Content = string(fileContent)
-			}
-
-			if ctx.Req.Gzip {
-				response.GzipEncode()
-			}
-
-			ctx.Res <- response
-			break
+	for _, index := range ctx.index {
+		if real, fi, err := ctx.resolve(file + index); err == nil && !fi.IsDir() {
+			return ctx.serveRegular(file+index, real)
 		}
 	}
-	ctx.Res <- ErrorResponse(404, "Not Found")
+	if ctx.listing {
+		return ctx.autoindex(file)
+	}
+	return ErrorResponse(404, "Not Found")
+}
+
+// serveRegular 处理普通文件，PHP 文件交给 FastCGI。real 为解析符号链接后的真实路径
+func (ctx *Context) serveRegular(file, real string) *Response {
+	if ctx.forbidden(file, real) {
+		return ctx.denied()
+	}
+
+	if strings.HasSuffix(file, ".php") {
+		if ctx.Vhost.Cache.Enable {
+			return responses.serve(ctx, file)
+		}
+		return ctx.fastcgi(file)
+	}
+	return ctx.static(file)
+}
+
+// forbidden 判断普通文件是否禁止访问：.ht 开头的文件和 PHP 源码总是禁止访问，
+// 经过符号链接时链接目标也要通过 deny 规则等同样的检查
+func (ctx *Context) forbidden(file, real string) bool {
+	check := func(file string) bool {
+		return ctx.Vhost.Deny.Denied(file) || htaccessFile(file) || ctx.Vhost.PHPSource(file)
+	}
+	if check(file) {
+		return true
+	}
+	target := ctx.rootPath(real)
+	return target != file && check(target)
+}
+
+// denied 按照虚拟主机的 deny.status 生成拒绝访问的响应
+func (ctx *Context) denied() *Response {
+	code := ctx.Vhost.Deny.Status
+	return ErrorResponse(code, HTTPStatusCode[code])
 }
 
-func pathExist(path string) bool {
-	_, err := os.Stat(path)
-	if err != nil && os.IsNotExist(err) {
-		return false
+// fastcgi 将请求交给 FastCGI Server 处理
+func (ctx *Context) fastcgi(file string) *Response {
+	response := &Response{
+		Code: 200,
 	}
-	return true
+
+	env := make(map[string]string)
+	for _, line := range ctx.Req.Headers[1:] {
+		splited := strings.SplitN(line, ":", 2)
+		if len(splited) != 2 {
+			continue
+		}
+		name := "HTTP_" + strings.ToUpper(strings.Replace(strings.TrimSpace(splited[0]), "-", "_", -1))
+		if name == "HTTP_PROXY" {
+			// httpoxy：不把 Proxy 头部传给应用
+			continue
+		}
+		if value, ok := env[name]; ok {
+			env[name] = value + ", " + strings.TrimSpace(splited[1])
+		} else {
+			env[name] = strings.TrimSpace(splited[1])
+		}
+	}
+	env["GATEWAY_INTERFACE"] = "CGI/1.1"
+	env["SERVER_PROTOCOL"] = ctx.Req.Proto
+	env["SCRIPT_FILENAME"] = ctx.Vhost.Root + file
+	env["SCRIPT_NAME"] = file
+	env["DOCUMENT_ROOT"] = ctx.Vhost.Root
+	env["REQUEST_URI"] = ctx.Req.RequestURI
+	env["SERVER_SOFTWARE"] = "Bronya/" + Version
+	env["SERVER_NAME"] = ctx.Req.Host
+	env["SERVER_PORT"] = ctx.Req.Port
+	env["HTTP_HOST"] = ctx.Req.Host
+	env["REMOTE_ADDR"] = ctx.Req.ClientIP()
+	env["REMOTE_PORT"] = ctx.Req.ClientPort()
+	env["QUERY_STRING"] = ctx.Req.Querys
+
+	upstream := ctx.Vhost.Fastcgi.Network + "://" + ctx.Vhost.Fastcgi.Address
+	log := ctx.log().With("upstream", upstream)
+	defer metrics.fastcgiStart(upstream)()
+	defer inflight.upstream(ctx.Req, upstream)()
+	fcgi, err := fcgi.Dial(ctx.Vhost.Fastcgi.Network, ctx.Vhost.Fastcgi.Address)
+	if err != nil {
+		metrics.fastcgiError(upstream, "connect")
+		log.Error("fastcgi connect failed", "error", err)
+		return ErrorResponse(502, "Bad Gateway")
+	}
+	defer fcgi.Close()
+
+	var resp *http.Response
+
+	if ctx.Req.Method == "POST" {
+		querys, err := url.ParseQuery(ctx.Req.Body)
+		if err != nil {
+			log.Error("invalid request body", "error", err)
+			return ErrorResponse(500, "Internal Server Error")
+		}
+
+		resp, err = fcgi.PostForm(env, querys)
+		if err != nil {
+			metrics.fastcgiError(upstream, "request")
+			log.Error("fastcgi request failed", "error", err)
+			return ErrorResponse(502, "Bad Gateway")
+		}
+	} else {
+		resp, err = fcgi.Get(env)
+		if err != nil {
+			metrics.fastcgiError(upstream, "request")
+			log.Error("fastcgi request failed", "error", err)
+			return ErrorResponse(502, "Bad Gateway")
+		}
+	}
+
+	response.Code = resp.StatusCode
+	for k, val := range resp.Header {
+		for _, v := range val {
+			response.Header(k + ": " + v)
+		}
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		metrics.fastcgiError(upstream, "response")
+		log.Error("fastcgi response failed", "error", err)
+		return ErrorResponse(502, "Bad Gateway")
+	}
+
+	response.Content = string(content)
+	return response
+}
+
+// log 返回带有请求 ID、虚拟主机和客户端地址的 Logger
+func (ctx *Context) log() *logger.Logger {
+	return logger.With("request_id", ctx.Req.RequestID, "vhost", vhostName(ctx.Vhost), "client", ctx.Req.ClientIP())
 }
 
-func isDir(path string) bool {
-	s, err := os.Stat(path)
+// static 读取静态文件
+func (ctx *Context) static(file string) *Response {
+	response := &Response{
+		Code: 200,
+	}
+	if ctx.Vhost.Compression.Precompressed {
+		resp, available := ctx.precompressed(file)
+		if resp != nil {
+			return resp
+		}
+		if available {
+			response.AddVary("Accept-Encoding")
+		}
+	}
+
+	f, err := ctx.open(file)
 	if err != nil {
-		return false
+		return pathError(file, err)
 	}
-	return s.IsDir()
+	defer f.Close()
+
+	fi := f.Stat()
+	response.source = &assetSource{path: f.Name(), modTime: fi.ModTime(), size: fi.Size()}
+	fileContent, err := f.ReadAll()
+	if err != nil {
+		logger.Warning.Println(err)
+		return ErrorResponse(500, "Internal Server Error")
+	}
+
+	response.Header("Content-Type: " + mime.TypeByExtension(path.Ext(file)))
+	response.Content = string(fileContent)
+	return response
 }
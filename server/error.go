@@ -1,6 +1,9 @@
 package server
 
-import "strconv"
+import (
+	"html"
+	"strconv"
+)
 
 // ErrorResponse 生成错误所需的 Response
 func ErrorResponse(code int, msg string) *Response {
@@ -11,3 +14,10 @@ func ErrorResponse(code int, msg string) *Response {
 	response.Header("Content-Type: text/html; charset=utf-8")
 	return response
 }
+
+// RedirectResponse 生成重定向响应
+func RedirectResponse(code int, location string) *Response {
+	response := ErrorResponse(code, "Redirecting to "+html.EscapeString(location))
+	response.Header("Location: " + location)
+	return response
+}
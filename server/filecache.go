@@ -0,0 +1,252 @@
+package server
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/logger"
+)
+
+// fileCacheEntry 存储一次路径解析的结果或一个打开的文件
+type fileCacheEntry struct {
+	key     string
+	lru     *list.List
+	dirs    []string
+	expires time.Time
+
+	real string
+	info os.FileInfo
+	err  error
+	file *openFile
+}
+
+// fileCache 在虚拟主机之间共享，缓存路径解析结果（包括不存在的路径）和打开的文件，
+// 条目在 TTL 到期、容量不足或所在目录发生变化（inotify）时失效
+type fileCache struct {
+	mutex      sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	maxOpen    int
+
+	stats   *list.List
+	files   *list.List
+	entries map[string]*list.Element
+	dirs    map[string]map[*list.Element]struct{}
+	watcher *fsnotify.Watcher
+
+	hits   uint64
+	misses uint64
+}
+
+// FileCacheStats 存储文件缓存的统计信息
+type FileCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Open    int
+}
+
+var files = &fileCache{
+	stats:   list.New(),
+	files:   list.New(),
+	entries: make(map[string]*list.Element),
+	dirs:    make(map[string]map[*list.Element]struct{}),
+}
+
+// FileCache 返回文件缓存的统计信息
+func FileCache() FileCacheStats {
+	files.mutex.Lock()
+	defer files.mutex.Unlock()
+	return FileCacheStats{
+		Hits:    atomic.LoadUint64(&files.hits),
+		Misses:  atomic.LoadUint64(&files.misses),
+		Entries: files.stats.Len(),
+		Open:    files.files.Len(),
+	}
+}
+
+// configure 应用新的缓存配置并清空已有的条目
+func (c *fileCache) configure(conf config.FileCache) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.ttl = time.Duration(conf.TTL) * time.Second
+	c.maxEntries = conf.MaxEntries
+	c.maxOpen = conf.MaxOpen
+	for _, l := range []*list.List{c.stats, c.files} {
+		for l.Len() > 0 {
+			c.removeLocked(l.Back())
+		}
+	}
+
+	if c.watcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			logger.Warning.Println("file cache falls back to TTL only:", err)
+			return
+		}
+		c.watcher = watcher
+		go c.watch()
+	}
+}
+
+func cacheKey(ctx *Context, file string) string {
+	return ctx.Vhost.Root + "\x00" + ctx.Vhost.Symlinks + "\x00" + file
+}
+
+// cacheable 判断解析错误是否可以缓存，只缓存路径不存在或被拒绝这类稳定的结果
+func cacheable(err error) bool {
+	return err == nil || os.IsNotExist(err) || err == errForbidden || isErrno(err, syscall.ENOTDIR)
+}
+
+func isErrno(err error, errno syscall.Errno) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err == errno
+	}
+	return err == errno
+}
+
+// resolve 返回缓存的路径解析结果，未命中时调用 ctx.walk 并缓存结果
+func (c *fileCache) resolve(ctx *Context, file string) (string, os.FileInfo, error) {
+	key := "stat\x00" + cacheKey(ctx, file)
+	c.mutex.Lock()
+	if entry := c.getLocked(key); entry != nil {
+		c.mutex.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return entry.real, entry.info, entry.err
+	}
+	c.mutex.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	real, fi, dirs, err := ctx.walk(file)
+	if cacheable(err) {
+		c.mutex.Lock()
+		c.putLocked(&fileCacheEntry{key: key, lru: c.stats, dirs: dirs, real: real, info: fi, err: err}, c.maxEntries)
+		c.mutex.Unlock()
+	}
+	return real, fi, err
+}
+
+// open 返回缓存的打开文件，调用者使用完毕后需要调用 Close
+func (c *fileCache) open(ctx *Context, file string) (*openFile, error) {
+	key := "open\x00" + cacheKey(ctx, file)
+	c.mutex.Lock()
+	if entry := c.getLocked(key); entry != nil {
+		atomic.AddInt32(&entry.file.refs, 1)
+		c.mutex.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		return entry.file, nil
+	}
+	c.mutex.Unlock()
+	atomic.AddUint64(&c.misses, 1)
+
+	f, err := ctx.openUncached(file)
+	if err != nil || c.maxOpen <= 0 {
+		return f, err
+	}
+	dirs := []string{filepath.Dir(f.Name())}
+	if _, _, walked, err := ctx.walk(file); err == nil {
+		dirs = append(walked, dirs...)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return f, nil
+	}
+	atomic.AddInt32(&f.refs, 1)
+	c.putLocked(&fileCacheEntry{key: key, lru: c.files, dirs: dirs, file: f}, c.maxOpen)
+	return f, nil
+}
+
+func (c *fileCache) getLocked(key string) *fileCacheEntry {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*fileCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeLocked(el)
+		return nil
+	}
+	entry.lru.MoveToFront(el)
+	return entry
+}
+
+func (c *fileCache) putLocked(entry *fileCacheEntry, max int) {
+	if max <= 0 {
+		if entry.file != nil {
+			entry.file.Close()
+		}
+		return
+	}
+	if el, ok := c.entries[entry.key]; ok {
+		c.removeLocked(el)
+	}
+	entry.expires = time.Now().Add(c.ttl)
+	el := entry.lru.PushFront(entry)
+	c.entries[entry.key] = el
+	for _, dir := range entry.dirs {
+		if c.dirs[dir] == nil {
+			c.dirs[dir] = make(map[*list.Element]struct{})
+			if c.watcher != nil {
+				c.watcher.Add(dir)
+			}
+		}
+		c.dirs[dir][el] = struct{}{}
+	}
+	for entry.lru.Len() > max {
+		c.removeLocked(entry.lru.Back())
+	}
+}
+
+func (c *fileCache) removeLocked(el *list.Element) {
+	entry := el.Value.(*fileCacheEntry)
+	entry.lru.Remove(el)
+	delete(c.entries, entry.key)
+	for _, dir := range entry.dirs {
+		delete(c.dirs[dir], el)
+		if len(c.dirs[dir]) == 0 {
+			delete(c.dirs, dir)
+			if c.watcher != nil {
+				c.watcher.Remove(dir)
+			}
+		}
+	}
+	if entry.file != nil {
+		entry.file.Close()
+	}
+}
+
+// invalidate 移除依赖指定目录的所有条目
+func (c *fileCache) invalidate(dir string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for el := range c.dirs[dir] {
+		c.removeLocked(el)
+	}
+}
+
+func (c *fileCache) watch() {
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			c.invalidate(filepath.Dir(event.Name))
+			c.invalidate(event.Name)
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warning.Println("file cache watcher:", err)
+		}
+	}
+}
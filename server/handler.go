@@ -2,47 +2,162 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
+	"io"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/logger"
+	"github.com/kotoyuuko/bronya/proxyproto"
 )
 
-// Handler 请求处理器
-func Handler(conn net.Conn) {
-	defer conn.Close()
+// handle 处理连接上的所有请求
+func (srv *Server) handle(c *conn) {
+	defer srv.trackConn(c, false)
+	defer c.Close()
+	c.opened()
+	defer c.closed()
+	atomic.AddUint64(&metrics.accepted, 1)
+	atomic.AddInt64(&metrics.open, 1)
+	defer atomic.AddInt64(&metrics.open, -1)
 
-	req := &Request{
-		Reader: bufio.NewReader(conn),
+	if err := proxyHeader(c.Conn); err != nil {
+		logger.Warning.Log("invalid PROXY header", "client", c.Conn.RemoteAddr(), "error", err)
+		return
 	}
 
-	req.ParseHeader()
-	req.ParseBody()
+	reader := bufio.NewReader(c)
+	for served := 0; ; served++ {
+		// 等待请求和读取头部共用同一个超时。关闭服务器时等待请求的连接会被直接关闭，
+		// 正在读取头部的连接最多再等待 shutdownHeaderTimeout
+		if keepAlive := config.Current().KeepAliveTimeout; keepAlive > 0 {
+			c.SetReadDeadline(time.Now().Add(time.Duration(keepAlive) * time.Second))
+		}
+		// 收到请求的第一个字节之前连接处于空闲状态
+		if _, err := reader.Peek(1); err != nil {
+			return
+		}
+		c.setState(stateReading)
 
-	vhost, _ := config.SearchVhost(req.Host)
+		req := &Request{
+			Reader:     reader,
+			RemoteAddr: c.RemoteAddr().String(),
+			TLS:        c.ln.TLS(),
+			RequestID:  newRequestID(),
+		}
+		if err := req.ParseHeader(config.Current().MaxBodySize); err != nil {
+			if err != io.EOF && len(req.Headers) > 0 {
+				logger.Warning.Log("malformed request", "client", req.RemoteAddr, "error", err)
+			}
+			if re, ok := err.(*requestError); ok {
+				// 无法确定请求内容在哪里结束，回复错误后关闭连接
+				c.setState(stateActive)
+				req.KeepConn = false
+				respond(c, req, ErrorResponse(re.code, re.msg))
+			}
+			return
+		}
+		c.setState(stateActive)
+		c.SetReadDeadline(time.Time{})
+		if err := req.ParseBody(); err != nil {
+			logger.Warning.Log("incomplete request body", "client", req.RemoteAddr, "error", err)
+			return
+		}
+		if served > 0 {
+			atomic.AddUint64(&metrics.keepAlive, 1)
+		}
+
+		keepConn := Handler(c, c.ln, req) && !srv.shuttingDown()
+		if !keepConn {
+			return
+		}
+		c.setState(stateIdle)
+	}
+}
+
+// Handler 处理单个请求，返回连接是否可以继续复用
+func Handler(conn net.Conn, ln *config.Listener, req *Request) bool {
+	// 整个请求使用同一份配置快照，重新加载配置不会影响处理中的请求
+	conf := config.Current()
+
+	if realIP := realIPFor(&conf.RealIP); realIP != nil {
+		req.RealIP = realIP.Resolve(req)
+	}
 
+	vhost, _ := conf.SearchVhost(req.Host, ln.Name)
+	inflight.add(req, ln, vhost)
+	defer inflight.remove(req)
+
+	var resp *Response
+	switch {
+	case conf.Metrics.Listener != "" && ln.Name == conf.Metrics.Listener && req.File == conf.Metrics.Path:
+		vhost = nil
+		resp = MetricsHandler(conf.Metrics, req)
+	case conf.Admin.Listener != "" && ln.Name == conf.Admin.Listener:
+		vhost = nil
+		resp = AdminHandler(conf.Admin, req)
+	case vhost == nil:
+		resp = ErrorResponse(404, "Not Found")
+	default:
+		resp = serveVhost(vhost, ln, req)
+	}
+
+	sent := respond(conn, req, resp)
+	rec := &accessRecord{
+		Listener: ln,
+		Vhost:    vhost,
+		Req:      req,
+		Res:      resp,
+		Sent:     sent,
+		End:      time.Now(),
+	}
+	metrics.observeRequest(rec)
+	accessLogs.log(conf.AccessLogFor(vhost), rec)
+	return req.KeepConn
+}
+
+// serveVhost 在虚拟主机上执行请求
+func serveVhost(vhost *config.Vhost, ln *config.Listener, req *Request) *Response {
 	ctx := &Context{
-		Vhost: vhost,
-		Req:   req,
-		Res:   make(chan interface{}),
-		Err:   make(chan error),
+		Vhost:    vhost,
+		Listener: ln,
+		Req:      req,
+		Res:      make(chan interface{}, 1),
+		Err:      make(chan error, 1),
 	}
 	go ctx.Exec()
 
-	for {
-		select {
-		case res := <-ctx.Res:
-			switch res.(type) {
-			case error:
-				DoResponse(conn, ErrorResponse(500, "Internal Server Error"))
-				break
-			case *Response:
-				DoResponse(conn, res.(*Response))
-				break
-			default:
-				DoResponse(conn, ErrorResponse(500, "Internal Server Error"))
-			}
-		case err := <-ctx.Err:
-			DoResponse(conn, ErrorResponse(500, err.Error()))
+	select {
+	case res := <-ctx.Res:
+		if resp, ok := res.(*Response); ok {
+			return resp
 		}
+		return ErrorResponse(500, "Internal Server Error")
+	case err := <-ctx.Err:
+		return ErrorResponse(500, err.Error())
+	}
+}
+
+// respond 根据连接复用情况补充 Connection 头部后发送响应，返回写入的字节数
+func respond(conn net.Conn, req *Request, resp *Response) int {
+	if req.KeepConn {
+		resp.Header("Connection: keep-alive")
+	} else {
+		resp.Header("Connection: close")
+	}
+	return DoResponse(conn, resp)
+}
+
+// proxyHeader 在处理请求前读取并校验 PROXY 头部
+func proxyHeader(conn net.Conn) error {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if pc, ok := conn.(*proxyproto.Conn); ok {
+		_, err := pc.Header()
+		return err
 	}
+	return nil
 }
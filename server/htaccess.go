@@ -0,0 +1,984 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kotoyuuko/bronya/logger"
+	"github.com/kotoyuuko/bronya/netutil"
+)
+
+// maxRewrites 内部重写后重新匹配 .htaccess 的最大次数
+const maxRewrites = 10
+
+// htaccessModules IfModule 中视为已加载的模块
+var htaccessModules = map[string]bool{
+	"core":          true,
+	"rewrite":       true,
+	"dir":           true,
+	"headers":       true,
+	"authz_core":    true,
+	"authz_host":    true,
+	"access_compat": true,
+}
+
+// htaccess 存储解析后的 .htaccess 文件，支持的指令见 README
+type htaccess struct {
+	file string
+	dir  string
+
+	rewriteEngine *bool
+	rewriteBase   string
+	rules         []*rewriteRule
+
+	index   []string
+	errors  map[int]string
+	access  *accessRules
+	headers []*headerRule
+	indexes *bool
+}
+
+type rewriteCond struct {
+	test    string
+	pattern string
+	regexp  *regexp.Regexp
+	negate  bool
+	or      bool
+}
+
+type rewriteRule struct {
+	conds     []*rewriteCond
+	regexp    *regexp.Regexp
+	negate    bool
+	target    string
+	last      bool
+	end       bool
+	qsa       bool
+	forbidden bool
+	gone      bool
+	noescape  bool
+	redirect  int
+}
+
+type accessRules struct {
+	order   string
+	allow   []*net.IPNet
+	deny    []*net.IPNet
+	require []*requireRule
+}
+
+type requireRule struct {
+	not   bool
+	all   bool
+	grant bool
+	nets  []*net.IPNet
+}
+
+type headerRule struct {
+	always bool
+	action string
+	name   string
+	value  string
+}
+
+type htaccessEntry struct {
+	modTime time.Time
+	size    int64
+	ht      *htaccess
+	err     error
+}
+
+var htaccessCache = struct {
+	sync.Mutex
+	entries map[string]*htaccessEntry
+}{entries: make(map[string]*htaccessEntry)}
+
+// loadHtaccess 读取 .htaccess 文件，解析结果按修改时间缓存，文件不存在时返回 nil
+func loadHtaccess(file, dir string) (*htaccess, error) {
+	fi, err := os.Stat(file)
+	if err != nil || fi.IsDir() {
+		htaccessCache.Lock()
+		delete(htaccessCache.entries, file)
+		htaccessCache.Unlock()
+		return nil, nil
+	}
+
+	htaccessCache.Lock()
+	entry, ok := htaccessCache.entries[file]
+	htaccessCache.Unlock()
+	if ok && entry.modTime.Equal(fi.ModTime()) && entry.size == fi.Size() {
+		return entry.ht, entry.err
+	}
+
+	ht, err := parseHtaccess(file, dir)
+	htaccessCache.Lock()
+	htaccessCache.entries[file] = &htaccessEntry{modTime: fi.ModTime(), size: fi.Size(), ht: ht, err: err}
+	htaccessCache.Unlock()
+	return ht, err
+}
+
+// parseHtaccess 解析 .htaccess 文件，遇到不支持的指令时返回错误
+func parseHtaccess(file, dir string) (*htaccess, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ht := &htaccess{file: file, dir: dir}
+	var conds []*rewriteCond
+	var active []bool
+
+	scanner := bufio.NewScanner(f)
+	lineNo, line := 0, ""
+	for scanner.Scan() {
+		lineNo++
+		text := strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+		line += text
+		text, line = strings.TrimSpace(line), ""
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fail := func(msg string) error {
+			return fmt.Errorf("%s:%d: %s", file, lineNo, msg)
+		}
+
+		if strings.HasPrefix(text, "</") {
+			if len(active) == 0 || !strings.EqualFold(strings.Trim(text, "</> \t"), "IfModule") {
+				return nil, fail("unexpected " + text)
+			}
+			active = active[:len(active)-1]
+			continue
+		}
+		if strings.HasPrefix(text, "<") {
+			args := splitArgs(strings.Trim(text, "<> \t"))
+			if len(args) != 2 || !strings.EqualFold(args[0], "IfModule") {
+				return nil, fail("unsupported section " + text)
+			}
+			name := args[1]
+			negate := strings.HasPrefix(name, "!")
+			name = strings.TrimPrefix(name, "!")
+			name = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSuffix(name, ".c"), "mod_"), "_module")
+			active = append(active, htaccessModules[name] != negate)
+			continue
+		}
+		if !allActive(active) {
+			continue
+		}
+
+		args := splitArgs(text)
+		directive, args := strings.ToLower(args[0]), args[1:]
+		if err := ht.directive(directive, args, &conds); err != nil {
+			return nil, fail(err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(active) > 0 {
+		return nil, fmt.Errorf("%s: unclosed <IfModule>", file)
+	}
+	if len(conds) > 0 {
+		return nil, fmt.Errorf("%s: RewriteCond without RewriteRule", file)
+	}
+	return ht, nil
+}
+
+func (ht *htaccess) directive(directive string, args []string, conds *[]*rewriteCond) error {
+	switch directive {
+	case "rewriteengine":
+		if len(args) != 1 {
+			return errors.New("RewriteEngine takes one argument")
+		}
+		on := strings.EqualFold(args[0], "on")
+		ht.rewriteEngine = &on
+	case "rewritebase":
+		if len(args) != 1 || !strings.HasPrefix(args[0], "/") {
+			return errors.New("RewriteBase takes one absolute URL path")
+		}
+		ht.rewriteBase = strings.TrimSuffix(args[0], "/") + "/"
+	case "rewritecond":
+		cond, err := parseRewriteCond(args)
+		if err != nil {
+			return err
+		}
+		*conds = append(*conds, cond)
+	case "rewriterule":
+		rule, err := parseRewriteRule(args)
+		if err != nil {
+			return err
+		}
+		rule.conds, *conds = *conds, nil
+		ht.rules = append(ht.rules, rule)
+	case "directoryindex":
+		if len(args) == 0 {
+			return errors.New("DirectoryIndex takes at least one file")
+		}
+		if len(args) == 1 && strings.EqualFold(args[0], "disabled") {
+			ht.index = []string{}
+		} else {
+			ht.index = args
+		}
+	case "errordocument":
+		if len(args) != 2 {
+			return errors.New("ErrorDocument takes a status code and a document")
+		}
+		code, err := strconv.Atoi(args[0])
+		if err != nil || code < 400 || code > 599 {
+			return errors.New("ErrorDocument: invalid status code " + args[0])
+		}
+		if ht.errors == nil {
+			ht.errors = make(map[int]string)
+		}
+		ht.errors[code] = args[1]
+	case "order":
+		if len(args) != 1 {
+			return errors.New("Order takes one argument")
+		}
+		order := strings.ToLower(strings.Replace(args[0], " ", "", -1))
+		if order != "deny,allow" && order != "allow,deny" {
+			return errors.New("Order: unsupported order " + args[0])
+		}
+		ht.accessRules().order = order
+	case "allow", "deny":
+		if len(args) < 2 || !strings.EqualFold(args[0], "from") {
+			return errors.New(directive + " from takes at least one host")
+		}
+		nets, err := parseHosts(args[1:])
+		if err != nil {
+			return err
+		}
+		if directive == "allow" {
+			ht.accessRules().allow = append(ht.accessRules().allow, nets...)
+		} else {
+			ht.accessRules().deny = append(ht.accessRules().deny, nets...)
+		}
+	case "require":
+		rule, err := parseRequire(args)
+		if err != nil {
+			return err
+		}
+		ht.accessRules().require = append(ht.accessRules().require, rule)
+	case "header":
+		rule, err := parseHeaderRule(args)
+		if err != nil {
+			return err
+		}
+		ht.headers = append(ht.headers, rule)
+	case "options":
+		for _, opt := range args {
+			switch strings.ToLower(strings.TrimLeft(opt, "+-")) {
+			case "indexes":
+				on := !strings.HasPrefix(opt, "-")
+				ht.indexes = &on
+			case "followsymlinks", "symlinksifownermatch", "multiviews", "execcgi", "includes", "all", "none":
+			default:
+				return errors.New("Options: unsupported option " + opt)
+			}
+		}
+	default:
+		return errors.New("unsupported directive " + directive)
+	}
+	return nil
+}
+
+func (ht *htaccess) accessRules() *accessRules {
+	if ht.access == nil {
+		ht.access = &accessRules{order: "deny,allow"}
+	}
+	return ht.access
+}
+
+func allActive(active []bool) bool {
+	for _, a := range active {
+		if !a {
+			return false
+		}
+	}
+	return true
+}
+
+// splitArgs 按空白拆分参数，支持双引号
+func splitArgs(s string) []string {
+	var args []string
+	var sb strings.Builder
+	quoted, inArg := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && quoted && i+1 < len(s) && s[i+1] == '"':
+			sb.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inArg {
+				args = append(args, sb.String())
+				sb.Reset()
+				inArg = false
+			}
+		default:
+			sb.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, sb.String())
+	}
+	return args
+}
+
+func parseFlags(arg string) ([]string, error) {
+	if !strings.HasPrefix(arg, "[") || !strings.HasSuffix(arg, "]") {
+		return nil, errors.New("invalid flags " + arg)
+	}
+	return strings.Split(strings.Trim(arg, "[]"), ","), nil
+}
+
+func parseRewriteCond(args []string) (*rewriteCond, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("RewriteCond takes a test string, a pattern and optional flags")
+	}
+	cond := &rewriteCond{test: args[0], pattern: args[1]}
+	if strings.HasPrefix(cond.pattern, "!") {
+		cond.negate = true
+		cond.pattern = cond.pattern[1:]
+	}
+
+	nocase := false
+	if len(args) == 3 {
+		flags, err := parseFlags(args[2])
+		if err != nil {
+			return nil, err
+		}
+		for _, flag := range flags {
+			switch strings.ToUpper(strings.TrimSpace(flag)) {
+			case "NC", "NOCASE":
+				nocase = true
+			case "OR", "ORNEXT":
+				cond.or = true
+			case "NV", "NOVARY":
+			default:
+				return nil, errors.New("RewriteCond: unsupported flag " + flag)
+			}
+		}
+	}
+
+	switch cond.pattern {
+	case "-f", "-d", "-s", "-l", "-F":
+		return cond, nil
+	}
+	if strings.HasPrefix(cond.pattern, "=") {
+		return cond, nil
+	}
+	if strings.HasPrefix(cond.pattern, "-") || strings.HasPrefix(cond.pattern, "<") || strings.HasPrefix(cond.pattern, ">") {
+		return nil, errors.New("RewriteCond: unsupported test " + cond.pattern)
+	}
+
+	expr := cond.pattern
+	if nocase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.New("RewriteCond: " + err.Error())
+	}
+	cond.regexp = re
+	return cond, nil
+}
+
+func parseRewriteRule(args []string) (*rewriteRule, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("RewriteRule takes a pattern, a substitution and optional flags")
+	}
+	rule := &rewriteRule{target: args[1]}
+	pattern := args[0]
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+
+	nocase := false
+	if len(args) == 3 {
+		flags, err := parseFlags(args[2])
+		if err != nil {
+			return nil, err
+		}
+		for _, flag := range flags {
+			flag = strings.TrimSpace(flag)
+			name, value := strings.ToUpper(flag), ""
+			if i := strings.Index(flag, "="); i >= 0 {
+				name, value = strings.ToUpper(flag[:i]), flag[i+1:]
+			}
+			switch name {
+			case "L", "LAST":
+				rule.last = true
+			case "END":
+				rule.last, rule.end = true, true
+			case "NC", "NOCASE":
+				nocase = true
+			case "QSA", "QSAPPEND":
+				rule.qsa = true
+			case "F", "FORBIDDEN":
+				rule.forbidden, rule.last = true, true
+			case "G", "GONE":
+				rule.gone, rule.last = true, true
+			case "R", "REDIRECT":
+				rule.redirect = 302
+				if value != "" {
+					code, err := strconv.Atoi(value)
+					if err != nil || code < 300 || code > 399 {
+						return nil, errors.New("RewriteRule: invalid redirect code " + value)
+					}
+					rule.redirect = code
+				}
+			case "NE", "NOESCAPE":
+				rule.noescape = true
+			case "PT", "PASSTHROUGH", "DPI", "DISCARDPATH":
+			default:
+				return nil, errors.New("RewriteRule: unsupported flag " + flag)
+			}
+		}
+	}
+
+	if nocase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.New("RewriteRule: " + err.Error())
+	}
+	rule.regexp = re
+	return rule, nil
+}
+
+// parseHosts 解析 Allow/Deny 的地址，支持 all、IP、CIDR、子网掩码以及部分 IP
+func parseHosts(hosts []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, host := range hosts {
+		switch {
+		case strings.EqualFold(host, "all"):
+			nets = append(nets, &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}, &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)})
+		case strings.Contains(host, "/"):
+			parts := strings.SplitN(host, "/", 2)
+			if mask := net.ParseIP(parts[1]); mask != nil && mask.To4() != nil {
+				ip := net.ParseIP(parts[0])
+				if ip == nil || ip.To4() == nil {
+					return nil, errors.New("invalid host " + host)
+				}
+				m := net.IPMask(mask.To4())
+				nets = append(nets, &net.IPNet{IP: ip.To4().Mask(m), Mask: m})
+				continue
+			}
+			_, n, err := net.ParseCIDR(host)
+			if err != nil {
+				return nil, errors.New("invalid host " + host)
+			}
+			nets = append(nets, n)
+		case net.ParseIP(host) != nil:
+			ip := net.ParseIP(host)
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			octets := strings.Split(strings.TrimSuffix(host, "."), ".")
+			if len(octets) > 3 {
+				return nil, errors.New("unsupported host " + host + ", only IP addresses are supported")
+			}
+			ip := make(net.IP, 4)
+			for i, octet := range octets {
+				n, err := strconv.Atoi(octet)
+				if err != nil || n < 0 || n > 255 {
+					return nil, errors.New("unsupported host " + host + ", only IP addresses are supported")
+				}
+				ip[i] = byte(n)
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(octets), 32)})
+		}
+	}
+	return nets, nil
+}
+
+func parseRequire(args []string) (*requireRule, error) {
+	rule := &requireRule{}
+	if len(args) > 0 && strings.EqualFold(args[0], "not") {
+		rule.not = true
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return nil, errors.New("Require takes an entity type")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "all":
+		if rule.not || len(args) != 2 {
+			return nil, errors.New("Require all takes granted or denied")
+		}
+		switch strings.ToLower(args[1]) {
+		case "granted":
+			rule.all, rule.grant = true, true
+		case "denied":
+			rule.all = true
+		default:
+			return nil, errors.New("Require all takes granted or denied")
+		}
+	case "ip":
+		nets, err := parseHosts(args[1:])
+		if err != nil {
+			return nil, err
+		}
+		rule.nets = nets
+	case "local":
+		nets, _ := parseHosts([]string{"127.0.0.0/8", "::1"})
+		rule.nets = nets
+	default:
+		return nil, errors.New("Require: unsupported entity " + args[0])
+	}
+	return rule, nil
+}
+
+func parseHeaderRule(args []string) (*headerRule, error) {
+	rule := &headerRule{}
+	if len(args) > 0 && (strings.EqualFold(args[0], "always") || strings.EqualFold(args[0], "onsuccess")) {
+		rule.always = strings.EqualFold(args[0], "always")
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return nil, errors.New("Header takes an action and a header name")
+	}
+	rule.action, rule.name = strings.ToLower(args[0]), args[1]
+	switch rule.action {
+	case "set", "append", "add", "merge":
+		if len(args) != 3 {
+			return nil, errors.New("Header " + rule.action + " takes a header name and a value")
+		}
+		rule.value = args[2]
+	case "unset":
+		if len(args) != 2 {
+			return nil, errors.New("Header unset takes a header name")
+		}
+	default:
+		return nil, errors.New("Header: unsupported action " + rule.action)
+	}
+	return rule, nil
+}
+
+// htaccessChain 按目录层级从根目录开始读取请求路径上的所有 .htaccess
+func (ctx *Context) htaccessChain(file string) ([]*htaccess, error) {
+	clean := path.Clean("/" + file)
+	dirs := []string{"/"}
+	parts := strings.Split(strings.Trim(clean, "/"), "/")
+	for i := range parts {
+		if parts[i] == "" {
+			continue
+		}
+		dirs = append(dirs, "/"+strings.Join(parts[:i+1], "/")+"/")
+	}
+
+	var chain []*htaccess
+	for _, dir := range dirs {
+		real, fi, err := ctx.resolve(dir)
+		if err != nil || !fi.IsDir() {
+			break
+		}
+		ht, err := loadHtaccess(filepath.Join(real, ".htaccess"), dir)
+		if err != nil {
+			return nil, err
+		}
+		if ht != nil {
+			chain = append(chain, ht)
+		}
+	}
+	return chain, nil
+}
+
+// mergeHtaccess 合并目录层级上的配置：子目录覆盖父目录，Header 依次累加，
+// 与 Apache 默认行为一致，重写规则只使用最深一层定义了规则的文件
+func mergeHtaccess(chain []*htaccess) *htaccess {
+	merged := &htaccess{errors: make(map[int]string)}
+	for _, ht := range chain {
+		if ht.rewriteEngine != nil || len(ht.rules) > 0 {
+			merged.file, merged.dir = ht.file, ht.dir
+			merged.rewriteEngine, merged.rewriteBase, merged.rules = ht.rewriteEngine, ht.rewriteBase, ht.rules
+		}
+		if ht.index != nil {
+			merged.index = ht.index
+		}
+		for code, doc := range ht.errors {
+			merged.errors[code] = doc
+		}
+		if ht.access != nil {
+			merged.access = ht.access
+		}
+		if ht.indexes != nil {
+			merged.indexes = ht.indexes
+		}
+		merged.headers = append(merged.headers, ht.headers...)
+	}
+	return merged
+}
+
+// applyHtaccess 读取并应用 .htaccess 中的访问控制与重写规则，
+// 返回非空的 Response 时直接使用它作为响应
+func (ctx *Context) applyHtaccess() (*htaccess, *Response) {
+	var ht *htaccess
+	for i := 0; i < maxRewrites; i++ {
+		chain, err := ctx.htaccessChain(ctx.Req.File)
+		if err != nil {
+			logger.Error.Println(err)
+			return nil, ErrorResponse(500, "Internal Server Error")
+		}
+		ht = mergeHtaccess(chain)
+
+		if ht.index != nil {
+			ctx.index = ht.index
+		}
+		if ht.indexes != nil {
+			ctx.listing = *ht.indexes
+		}
+		if ht.access != nil && !ht.access.allows(net.ParseIP(ctx.Req.ClientIP())) {
+			return ht, ErrorResponse(403, "Forbidden")
+		}
+
+		changed, end, resp := ht.rewrite(ctx)
+		if resp != nil || !changed || end {
+			return ht, resp
+		}
+	}
+
+	logger.Error.Println(ctx.Vhost.Root+ctx.Req.File, "exceeded", maxRewrites, "internal rewrites")
+	return ht, ErrorResponse(500, "Internal Server Error")
+}
+
+func (rules *accessRules) allows(ip net.IP) bool {
+	if len(rules.require) > 0 {
+		granted, positive := false, false
+		for _, rule := range rules.require {
+			matched := rule.matches(ip)
+			if rule.not {
+				if matched {
+					return false
+				}
+				continue
+			}
+			positive = true
+			granted = granted || matched
+		}
+		return granted || !positive
+	}
+
+	allowed, denied := netutil.ContainsIP(rules.allow, ip), netutil.ContainsIP(rules.deny, ip)
+	if rules.order == "allow,deny" {
+		return allowed && !denied
+	}
+	return allowed || !denied
+}
+
+func (rule *requireRule) matches(ip net.IP) bool {
+	if rule.all {
+		return rule.grant
+	}
+	return netutil.ContainsIP(rule.nets, ip)
+}
+
+// htaccessFile 判断文件名是否以 .ht 开头，.htaccess、.htpasswd 等文件总是禁止访问，不受 deny 配置影响
+func htaccessFile(file string) bool {
+	return strings.HasPrefix(strings.ToLower(path.Base(file)), ".ht")
+}
+
+// rewrite 按顺序执行重写规则，返回路径是否被修改以及是否停止后续重写
+func (ht *htaccess) rewrite(ctx *Context) (changed bool, end bool, resp *Response) {
+	if ht.rewriteEngine == nil || !*ht.rewriteEngine || !strings.HasPrefix(ctx.Req.File+"/", ht.dir) {
+		return false, false, nil
+	}
+
+	for _, rule := range ht.rules {
+		rel := strings.TrimPrefix(ctx.Req.File, ht.dir)
+		match := rule.regexp.FindStringSubmatch(rel)
+		if (match == nil) != rule.negate {
+			continue
+		}
+		if rule.negate {
+			match = []string{rel}
+		}
+
+		condMatch, ok := ht.checkConds(ctx, rule, match)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case rule.forbidden:
+			return false, true, ErrorResponse(403, "Forbidden")
+		case rule.gone:
+			return false, true, ErrorResponse(410, "Gone")
+		}
+
+		if rule.target != "-" {
+			target := ht.expand(ctx, rule.target, match, condMatch)
+			file, query := target, ctx.Req.Querys
+			if i := strings.Index(target, "?"); i >= 0 {
+				file, query = target[:i], target[i+1:]
+				if rule.qsa && ctx.Req.Querys != "" {
+					query = strings.TrimSuffix(query+"&"+ctx.Req.Querys, "&")
+				}
+			}
+			external := strings.Contains(file, "://")
+			if !external && !strings.HasPrefix(file, "/") {
+				base := ht.dir
+				if ht.rewriteBase != "" {
+					base = ht.rewriteBase
+				}
+				file = base + file
+			}
+
+			if rule.redirect != 0 || external {
+				code := rule.redirect
+				if code == 0 {
+					code = 302
+				}
+				// 目标中的反向引用来自解码后的路径，必须重新编码，防止 CR、LF 注入响应头部
+				location := escapeLocation(file, !rule.noescape)
+				if query != "" {
+					location += "?" + escapeLocation(query, !rule.noescape)
+				}
+				return false, true, RedirectResponse(code, location)
+			}
+
+			file = cleanSlash(file)
+			if file != ctx.Req.File || query != ctx.Req.Querys {
+				ctx.Req.File, ctx.Req.Querys = file, query
+				changed = true
+			}
+		}
+
+		if rule.end {
+			return changed, true, nil
+		}
+		if rule.last {
+			break
+		}
+	}
+	return changed, false, nil
+}
+
+// checkConds 依次检查 RewriteCond，返回最后一个匹配的条件的捕获组
+func (ht *htaccess) checkConds(ctx *Context, rule *rewriteRule, match []string) ([]string, bool) {
+	var condMatch []string
+	ok := true
+	for i, cond := range rule.conds {
+		if !ok && (i == 0 || !rule.conds[i-1].or) {
+			return nil, false
+		}
+		if ok && i > 0 && rule.conds[i-1].or {
+			// 前一个 OR 条件已经满足，跳过剩余的 OR 条件
+			continue
+		}
+
+		test := ht.expand(ctx, cond.test, match, condMatch)
+		var result bool
+		switch {
+		case cond.regexp != nil:
+			m := cond.regexp.FindStringSubmatch(test)
+			result = m != nil
+			if result && !cond.negate {
+				condMatch = m
+			}
+		case strings.HasPrefix(cond.pattern, "="):
+			result = test == cond.pattern[1:]
+		default:
+			result = testFile(test, cond.pattern)
+		}
+		ok = result != cond.negate
+	}
+	return condMatch, ok
+}
+
+func testFile(file, test string) bool {
+	fi, err := os.Lstat(file)
+	if err != nil {
+		return false
+	}
+	if test == "-l" {
+		return fi.Mode()&os.ModeSymlink != 0
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if fi, err = os.Stat(file); err != nil {
+			return false
+		}
+	}
+	switch test {
+	case "-d":
+		return fi.IsDir()
+	case "-s":
+		return fi.Mode().IsRegular() && fi.Size() > 0
+	}
+	return fi.Mode().IsRegular()
+}
+
+var expandPattern = regexp.MustCompile(`\$[0-9]|%[0-9]|%\{[A-Za-z0-9_:-]+\}`)
+
+// expand 替换 $N、%N 引用以及 %{VAR} 服务器变量
+func (ht *htaccess) expand(ctx *Context, s string, match, condMatch []string) string {
+	return expandPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		switch ref[0] {
+		case '$':
+			n := int(ref[1] - '0')
+			if n < len(match) {
+				return match[n]
+			}
+			return ""
+		}
+		if ref[1] != '{' {
+			n := int(ref[1] - '0')
+			if n < len(condMatch) {
+				return condMatch[n]
+			}
+			return ""
+		}
+		return ctx.serverVar(ref[2 : len(ref)-1])
+	})
+}
+
+// serverVar 返回 RewriteCond 中可以使用的服务器变量
+func (ctx *Context) serverVar(name string) string {
+	req := ctx.Req
+	if strings.HasPrefix(strings.ToUpper(name), "HTTP:") {
+		return strings.Join(req.HeaderValues(name[5:]), ", ")
+	}
+
+	switch strings.ToUpper(name) {
+	case "REQUEST_FILENAME", "SCRIPT_FILENAME":
+		return ctx.Vhost.Root + req.File
+	case "REQUEST_URI":
+		// 使用请求行中未解码的路径，重写规则把它拼入重定向目标时不会产生控制字符
+		return strings.SplitN(req.RequestURI, "?", 2)[0]
+	case "QUERY_STRING":
+		return req.Querys
+	case "DOCUMENT_ROOT":
+		return ctx.Vhost.Root
+	case "REQUEST_METHOD":
+		return req.Method
+	case "REMOTE_ADDR":
+		return req.ClientIP()
+	case "SERVER_NAME", "HTTP_HOST":
+		return req.Host
+	case "SERVER_PORT":
+		return req.Port
+	case "THE_REQUEST":
+		if len(req.Headers) > 0 {
+			return req.Headers[0]
+		}
+	case "SERVER_PROTOCOL":
+		return req.Proto
+	case "HTTPS":
+		if req.TLS {
+			return "on"
+		}
+		return "off"
+	case "REQUEST_SCHEME":
+		if req.TLS {
+			return "https"
+		}
+		return "http"
+	case "HTTP_USER_AGENT", "HTTP_REFERER", "HTTP_COOKIE", "HTTP_ACCEPT", "HTTP_FORWARDED":
+		header := strings.Replace(strings.TrimPrefix(strings.ToUpper(name), "HTTP_"), "_", "-", -1)
+		return strings.Join(req.HeaderValues(header), ", ")
+	}
+	return ""
+}
+
+// finish 为响应应用 ErrorDocument 和 Header 指令
+func (ht *htaccess) finish(ctx *Context, resp *Response) *Response {
+	if doc, ok := ht.errors[resp.Code]; ok && resp.Code >= 400 {
+		resp = ht.errorDocument(ctx, resp.Code, doc)
+	}
+
+	for _, rule := range ht.headers {
+		if !rule.always && resp.Code >= 400 {
+			continue
+		}
+		if resp.Headers == nil {
+			resp.Headers = make(map[string]string)
+		}
+		name := canonicalHeader(rule.name)
+		existing, ok := resp.Headers[name]
+		switch rule.action {
+		case "set":
+			resp.Headers[name] = rule.value
+		case "unset":
+			delete(resp.Headers, name)
+		case "append", "add":
+			if ok {
+				resp.Headers[name] = existing + ", " + rule.value
+			} else {
+				resp.Headers[name] = rule.value
+			}
+		case "merge":
+			if !ok {
+				resp.Headers[name] = rule.value
+			} else if !strings.Contains(existing, rule.value) {
+				resp.Headers[name] = existing + ", " + rule.value
+			}
+		}
+	}
+	return resp
+}
+
+func (ht *htaccess) errorDocument(ctx *Context, code int, doc string) *Response {
+	switch {
+	case strings.Contains(doc, "://"):
+		return RedirectResponse(302, doc)
+	case strings.HasPrefix(doc, "/"):
+		file := path.Clean(doc)
+		real, fi, err := ctx.resolve(file)
+		if err != nil || fi.IsDir() {
+			logger.Warning.Println("ErrorDocument", ctx.Vhost.Root+file, "does not exist")
+			return ErrorResponse(code, HTTPStatusCode[code])
+		}
+		// 与普通请求一样检查 deny 规则、.ht 文件和 PHP 源码，避免通过 ErrorDocument 读取禁止访问的文件
+		if ctx.forbidden(file, real) {
+			logger.Warning.Println("ErrorDocument", ctx.Vhost.Root+file, "is denied")
+			return ErrorResponse(code, HTTPStatusCode[code])
+		}
+		var resp *Response
+		if strings.HasSuffix(file, ".php") {
+			resp = ctx.fastcgi(file)
+		} else {
+			resp = ctx.static(file)
+		}
+		resp.Code = code
+		return resp
+	}
+	resp := &Response{Code: code, Content: doc}
+	resp.Header("Content-Type: text/html; charset=utf-8")
+	return resp
+}
+
+func canonicalHeader(name string) string {
+	parts := strings.Split(strings.ToLower(name), "-")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "-")
+}
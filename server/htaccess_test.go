@@ -0,0 +1,33 @@
+package server
+
+import "testing"
+
+func TestErrorDocumentDenied(t *testing.T) {
+	vhost := newDenyVhost(t)
+	tests := []struct {
+		doc     string
+		content string
+	}{
+		{doc: "/page.html", content: "page"},
+		{doc: "/link.html", content: "page"},
+		{doc: "/.env"},
+		{doc: "/.htpasswd"},
+		{doc: "/env.txt"},
+		{doc: "/dump.txt"},
+		{doc: "/config.inc"},
+		{doc: "/missing.html"},
+	}
+	for _, tt := range tests {
+		ctx := &Context{Vhost: vhost, Req: &Request{File: "/missing"}}
+		resp := (&htaccess{}).errorDocument(ctx, 404, tt.doc)
+		if resp.Code != 404 {
+			t.Errorf("ErrorDocument %s: code = %d, want 404", tt.doc, resp.Code)
+		}
+		if tt.content != "" && resp.Content != tt.content {
+			t.Errorf("ErrorDocument %s: content = %q, want %q", tt.doc, resp.Content, tt.content)
+		}
+		if tt.content == "" && resp.Content != ErrorResponse(404, "Not Found").Content {
+			t.Errorf("ErrorDocument %s: served %q, want the default error page", tt.doc, resp.Content)
+		}
+	}
+}
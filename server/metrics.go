@@ -0,0 +1,318 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/netutil"
+)
+
+// durationBuckets 耗时直方图的上界，单位为秒
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricVec 是按标签区分的计数器或者仪表盘，键为编码后的标签
+type metricVec struct {
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func newMetricVec() *metricVec {
+	return &metricVec{values: make(map[string]float64)}
+}
+
+func (m *metricVec) add(labels string, v float64) {
+	m.mutex.Lock()
+	m.values[labels] += v
+	m.mutex.Unlock()
+}
+
+// histogram 存储一组标签的直方图数据，counts[i] 为不大于 buckets[i] 的观测次数
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec 是按标签区分的直方图
+type histogramVec struct {
+	mutex   sync.Mutex
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(buckets []float64) *histogramVec {
+	return &histogramVec{buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(labels string, v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hist := h.values[labels]
+	if hist == nil {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[labels] = hist
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+// vhostTotals 存储虚拟主机的请求统计，用于状态页，Codes[i] 为 (i+1)xx 状态码的请求数
+type vhostTotals struct {
+	Requests      uint64
+	Codes         [5]uint64
+	BytesReceived int64
+	BytesSent     int64
+	Duration      time.Duration
+}
+
+// serverMetrics 存储服务器运行时收集的指标
+type serverMetrics struct {
+	start time.Time
+
+	vhostMutex sync.Mutex
+	vhosts     map[string]*vhostTotals
+
+	requests      *metricVec
+	requestBytes  *metricVec
+	responseBytes *metricVec
+	duration      *histogramVec
+
+	accepted  uint64
+	open      int64
+	keepAlive uint64
+
+	fastcgiDuration *histogramVec
+	fastcgiErrors   *metricVec
+	fastcgiActive   *metricVec
+
+	compressIn  *metricVec
+	compressOut *metricVec
+}
+
+var metrics = &serverMetrics{
+	start:           time.Now(),
+	vhosts:          make(map[string]*vhostTotals),
+	requests:        newMetricVec(),
+	requestBytes:    newMetricVec(),
+	responseBytes:   newMetricVec(),
+	duration:        newHistogramVec(durationBuckets),
+	fastcgiDuration: newHistogramVec(durationBuckets),
+	fastcgiErrors:   newMetricVec(),
+	fastcgiActive:   newMetricVec(),
+	compressIn:      newMetricVec(),
+	compressOut:     newMetricVec(),
+}
+
+// labels 将 key、value 交替排列的标签编码为 Prometheus 格式
+func labels(kv ...string) string {
+	pairs := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		pairs = append(pairs, kv[i]+`="`+value+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// metricMethod 将请求方法归类，避免任意方法产生过多的标签值
+func metricMethod(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+// observeRequest 记录一次请求
+func (m *serverMetrics) observeRequest(rec *accessRecord) {
+	vhost := ""
+	if rec.Vhost != nil {
+		vhost = vhostName(rec.Vhost)
+	}
+	class := strconv.Itoa(rec.Res.Code/100) + "xx"
+	m.requests.add(labels("vhost", vhost, "method", metricMethod(rec.Req.Method), "code", class), 1)
+	m.requestBytes.add(labels("vhost", vhost), float64(rec.requestLength()))
+	m.responseBytes.add(labels("vhost", vhost), float64(rec.Sent))
+	m.duration.observe(labels("vhost", vhost), rec.duration().Seconds())
+
+	m.vhostMutex.Lock()
+	defer m.vhostMutex.Unlock()
+	totals := m.vhosts[vhost]
+	if totals == nil {
+		totals = &vhostTotals{}
+		m.vhosts[vhost] = totals
+	}
+	totals.Requests++
+	if i := rec.Res.Code/100 - 1; i >= 0 && i < len(totals.Codes) {
+		totals.Codes[i]++
+	}
+	totals.BytesReceived += int64(rec.requestLength())
+	totals.BytesSent += int64(rec.Sent)
+	totals.Duration += rec.duration()
+}
+
+// vhostSnapshot 返回各虚拟主机请求统计的副本
+func (m *serverMetrics) vhostSnapshot() map[string]vhostTotals {
+	m.vhostMutex.Lock()
+	defer m.vhostMutex.Unlock()
+	snapshot := make(map[string]vhostTotals, len(m.vhosts))
+	for name, totals := range m.vhosts {
+		snapshot[name] = *totals
+	}
+	return snapshot
+}
+
+// fastcgiStart 记录开始请求 FastCGI，返回的函数在请求结束时调用
+func (m *serverMetrics) fastcgiStart(upstream string) func() {
+	l := labels("upstream", upstream)
+	start := time.Now()
+	m.fastcgiActive.add(l, 1)
+	return func() {
+		m.fastcgiActive.add(l, -1)
+		m.fastcgiDuration.observe(l, time.Since(start).Seconds())
+	}
+}
+
+// fastcgiError 记录 FastCGI 错误，stage 为 connect、request 或 response
+func (m *serverMetrics) fastcgiError(upstream, stage string) {
+	m.fastcgiErrors.add(labels("upstream", upstream, "stage", stage), 1)
+}
+
+// observeCompression 记录压缩前后的长度
+func (m *serverMetrics) observeCompression(encoding string, in, out int) {
+	m.compressIn.add(labels("encoding", encoding), float64(in))
+	m.compressOut.add(labels("encoding", encoding), float64(out))
+}
+
+// MetricsHandler 以 Prometheus 文本格式输出指标
+func MetricsHandler(conf config.Metrics, req *Request) *Response {
+	if len(conf.Networks) > 0 && !netutil.ContainsIP(conf.Networks, net.ParseIP(req.ClientIP())) {
+		return ErrorResponse(403, "Forbidden")
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp := ErrorResponse(405, "Method Not Allowed")
+		resp.Header("Allow: GET, HEAD")
+		return resp
+	}
+
+	var buf bytes.Buffer
+	m := metrics
+	writeMetric(&buf, "bronya_build_info", "gauge", "Bronya version.", map[string]float64{labels("version", Version): 1})
+	writeMetric(&buf, "bronya_start_time_seconds", "gauge", "Start time of the process since the Unix epoch.", single(float64(m.start.UnixNano())/1e9))
+	writeMetric(&buf, "bronya_config_generation", "gauge", "Number of times the config has been loaded.", single(float64(config.Generation())))
+
+	writeVec(&buf, "bronya_http_requests_total", "counter", "HTTP requests by vhost, method and status class.", m.requests)
+	writeHistogram(&buf, "bronya_http_request_duration_seconds", "HTTP request latency from the request line to the end of the response.", m.duration)
+	writeVec(&buf, "bronya_http_request_bytes_total", "counter", "Bytes received in requests, including headers.", m.requestBytes)
+	writeVec(&buf, "bronya_http_response_bytes_total", "counter", "Bytes sent in responses, including headers.", m.responseBytes)
+
+	writeMetric(&buf, "bronya_connections_accepted_total", "counter", "Accepted client connections.", single(float64(atomic.LoadUint64(&m.accepted))))
+	writeMetric(&buf, "bronya_connections_active", "gauge", "Open client connections.", single(float64(atomic.LoadInt64(&m.open))))
+	writeMetric(&buf, "bronya_keepalive_requests_total", "counter", "Requests served on a reused keep-alive connection.", single(float64(atomic.LoadUint64(&m.keepAlive))))
+
+	writeHistogram(&buf, "bronya_fastcgi_request_duration_seconds", "FastCGI request latency by upstream.", m.fastcgiDuration)
+	writeVec(&buf, "bronya_fastcgi_errors_total", "counter", "FastCGI errors by upstream and stage.", m.fastcgiErrors)
+	writeVec(&buf, "bronya_fastcgi_active_requests", "gauge", "In-flight FastCGI requests by upstream; each request uses its own connection.", m.fastcgiActive)
+
+	writeVec(&buf, "bronya_compression_input_bytes_total", "counter", "Response bytes before compression by encoding.", m.compressIn)
+	writeVec(&buf, "bronya_compression_output_bytes_total", "counter", "Response bytes after compression by encoding.", m.compressOut)
+
+	as := AssetCache()
+	writeMetric(&buf, "bronya_asset_cache_requests_total", "counter", "Compressed static asset cache lookups.", map[string]float64{labels("result", "hit"): float64(as.Hits), labels("result", "miss"): float64(as.Misses)})
+	writeMetric(&buf, "bronya_asset_cache_evictions_total", "counter", "Compressed static asset cache evictions.", single(float64(as.Evictions)))
+	writeMetric(&buf, "bronya_asset_cache_entries", "gauge", "Compressed static asset cache entries.", single(float64(as.Entries)))
+	writeMetric(&buf, "bronya_asset_cache_bytes", "gauge", "Compressed static asset cache size.", single(float64(as.Size)))
+	writeMetric(&buf, "bronya_asset_cache_max_bytes", "gauge", "Compressed static asset cache capacity.", single(float64(as.MaxSize)))
+
+	fs := FileCache()
+	writeMetric(&buf, "bronya_file_cache_requests_total", "counter", "Stat and open-file cache lookups.", map[string]float64{labels("result", "hit"): float64(fs.Hits), labels("result", "miss"): float64(fs.Misses)})
+	writeMetric(&buf, "bronya_file_cache_entries", "gauge", "Cached stat results.", single(float64(fs.Entries)))
+	writeMetric(&buf, "bronya_file_cache_open_files", "gauge", "Cached open file descriptors.", single(float64(fs.Open)))
+
+	rs := ResponseCache()
+	writeMetric(&buf, "bronya_response_cache_requests_total", "counter", "FastCGI response cache lookups by X-Cache result.", map[string]float64{
+		labels("result", "hit"):     float64(rs.Hits),
+		labels("result", "miss"):    float64(rs.Misses),
+		labels("result", "expired"): float64(rs.Expired),
+		labels("result", "stale"):   float64(rs.Stale),
+		labels("result", "bypass"):  float64(rs.Bypass),
+	})
+	writeMetric(&buf, "bronya_response_cache_entries", "gauge", "FastCGI response cache entries.", single(float64(rs.Entries)))
+	writeMetric(&buf, "bronya_response_cache_bytes", "gauge", "FastCGI response cache size on disk.", single(float64(rs.Size)))
+	writeMetric(&buf, "bronya_response_cache_max_bytes", "gauge", "FastCGI response cache capacity.", single(float64(rs.MaxSize)))
+
+	resp := &Response{Code: 200, Content: buf.String()}
+	resp.Header("Content-Type: text/plain; version=0.0.4; charset=utf-8")
+	resp.Header("Cache-Control: no-store")
+	return resp
+}
+
+func single(v float64) map[string]float64 {
+	return map[string]float64{"": v}
+}
+
+func writeMetric(buf *bytes.Buffer, name, typ, help string, values map[string]float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "" {
+			fmt.Fprintf(buf, "%s %s\n", name, formatFloat(values[k]))
+		} else {
+			fmt.Fprintf(buf, "%s{%s} %s\n", name, k, formatFloat(values[k]))
+		}
+	}
+}
+
+func writeVec(buf *bytes.Buffer, name, typ, help string, vec *metricVec) {
+	vec.mutex.Lock()
+	values := make(map[string]float64, len(vec.values))
+	for k, v := range vec.values {
+		values[k] = v
+	}
+	vec.mutex.Unlock()
+	writeMetric(buf, name, typ, help, values)
+}
+
+func writeHistogram(buf *bytes.Buffer, name, help string, vec *histogramVec) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	keys := make([]string, 0, len(vec.values))
+	for k := range vec.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := vec.values[k]
+		prefix := k
+		if prefix != "" {
+			prefix += ","
+		}
+		for i, upper := range vec.buckets {
+			fmt.Fprintf(buf, "%s_bucket{%sle=\"%s\"} %d\n", name, prefix, formatFloat(upper), hist.counts[i])
+		}
+		fmt.Fprintf(buf, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, hist.count)
+		fmt.Fprintf(buf, "%s_sum{%s} %s\n", name, k, formatFloat(hist.sum))
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", name, k, hist.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
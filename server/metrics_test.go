@@ -0,0 +1,255 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/netutil"
+)
+
+// sample 是指标输出中的一行数据
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// parseExposition 解析 Prometheus 文本格式，返回各指标的类型与所有数据行
+func parseExposition(t *testing.T, text string) (map[string]string, []sample) {
+	t.Helper()
+	types := make(map[string]string)
+	var samples []sample
+	for i, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			fields := strings.Fields(strings.TrimPrefix(line, "# TYPE "))
+			if len(fields) != 2 {
+				t.Fatalf("line %d: malformed TYPE: %q", i+1, line)
+			}
+			types[fields[0]] = fields[1]
+			continue
+		}
+
+		s := sample{labels: make(map[string]string)}
+		rest := line
+		if j := strings.IndexAny(line, "{ "); j >= 0 && line[j] == '{' {
+			s.name = line[:j]
+			rest = parseLabels(t, i+1, line[j+1:], s.labels)
+		} else if j >= 0 {
+			s.name, rest = line[:j], line[j:]
+		}
+		value, err := strconv.ParseFloat(strings.TrimPrefix(rest, " "), 64)
+		if s.name == "" || !strings.HasPrefix(rest, " ") || err != nil {
+			t.Fatalf("line %d: malformed sample: %q", i+1, line)
+		}
+		s.value = value
+		samples = append(samples, s)
+	}
+	return types, samples
+}
+
+// parseLabels 解析 name="value",... 形式的标签直到 }，返回剩余的内容
+func parseLabels(t *testing.T, n int, s string, labels map[string]string) string {
+	t.Helper()
+	for {
+		if strings.HasPrefix(s, "}") {
+			return s[1:]
+		}
+		eq := strings.Index(s, `="`)
+		if eq <= 0 {
+			t.Fatalf("line %d: malformed labels: %q", n, s)
+		}
+		name := s[:eq]
+		s = s[eq+2:]
+		var value strings.Builder
+		for {
+			if s == "" {
+				t.Fatalf("line %d: unterminated label %s", n, name)
+			}
+			c := s[0]
+			s = s[1:]
+			if c == '"' {
+				break
+			}
+			if c == '\\' && s != "" {
+				switch s[0] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[0])
+				}
+				s = s[1:]
+				continue
+			}
+			value.WriteByte(c)
+		}
+		labels[name] = value.String()
+		s = strings.TrimPrefix(s, ",")
+	}
+}
+
+// family 返回数据行所属的指标，直方图的 _bucket、_sum、_count 归入同一指标
+func family(name string, types map[string]string) string {
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		base := strings.TrimSuffix(name, suffix)
+		if base != name && types[base] == "histogram" {
+			return base
+		}
+	}
+	return name
+}
+
+func labelNames(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != "le" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestMetricsExposition(t *testing.T) {
+	vhost := `a"b\c.test`
+	start := time.Now().Add(-20 * time.Millisecond)
+	metrics.observeRequest(&accessRecord{
+		Vhost: &config.Vhost{Name: []string{vhost}},
+		Req:   &Request{Method: "PROPFIND", Headers: []string{"GET / HTTP/1.1", "Host: a.test"}, Start: start},
+		Res:   &Response{Code: 404},
+		Sent:  120,
+		End:   time.Now(),
+	})
+	metrics.fastcgiStart("tcp://127.0.0.1:9000")()
+	metrics.fastcgiError("tcp://127.0.0.1:9000", "connect")
+	metrics.observeCompression("gzip", 1000, 300)
+
+	resp := MetricsHandler(config.Metrics{}, &Request{Method: "GET", RemoteAddr: "127.0.0.1:40000"})
+	if resp.Code != 200 {
+		t.Fatalf("code = %d, want 200", resp.Code)
+	}
+	types, samples := parseExposition(t, resp.Content)
+
+	// 与 README 中列出的指标保持一致
+	tests := []struct {
+		name   string
+		typ    string
+		labels string
+	}{
+		{"bronya_build_info", "gauge", "version"},
+		{"bronya_start_time_seconds", "gauge", ""},
+		{"bronya_config_generation", "gauge", ""},
+		{"bronya_http_requests_total", "counter", "code,method,vhost"},
+		{"bronya_http_request_duration_seconds", "histogram", "vhost"},
+		{"bronya_http_request_bytes_total", "counter", "vhost"},
+		{"bronya_http_response_bytes_total", "counter", "vhost"},
+		{"bronya_connections_accepted_total", "counter", ""},
+		{"bronya_connections_active", "gauge", ""},
+		{"bronya_keepalive_requests_total", "counter", ""},
+		{"bronya_fastcgi_request_duration_seconds", "histogram", "upstream"},
+		{"bronya_fastcgi_errors_total", "counter", "stage,upstream"},
+		{"bronya_fastcgi_active_requests", "gauge", "upstream"},
+		{"bronya_compression_input_bytes_total", "counter", "encoding"},
+		{"bronya_compression_output_bytes_total", "counter", "encoding"},
+		{"bronya_asset_cache_requests_total", "counter", "result"},
+		{"bronya_asset_cache_evictions_total", "counter", ""},
+		{"bronya_asset_cache_entries", "gauge", ""},
+		{"bronya_asset_cache_bytes", "gauge", ""},
+		{"bronya_asset_cache_max_bytes", "gauge", ""},
+		{"bronya_file_cache_requests_total", "counter", "result"},
+		{"bronya_file_cache_entries", "gauge", ""},
+		{"bronya_file_cache_open_files", "gauge", ""},
+		{"bronya_response_cache_requests_total", "counter", "result"},
+		{"bronya_response_cache_entries", "gauge", ""},
+		{"bronya_response_cache_bytes", "gauge", ""},
+		{"bronya_response_cache_max_bytes", "gauge", ""},
+	}
+	found := make(map[string]int)
+	for _, s := range samples {
+		name := family(s.name, types)
+		if types[name] == "" {
+			t.Errorf("%s has no TYPE line", s.name)
+		}
+		if s.name != name {
+			if _, ok := s.labels["le"]; ok != strings.HasSuffix(s.name, "_bucket") {
+				t.Errorf("%s: le label only belongs on buckets, got %v", s.name, s.labels)
+			}
+		}
+		found[name]++
+	}
+	for _, tt := range tests {
+		if types[tt.name] != tt.typ {
+			t.Errorf("%s: type = %q, want %q", tt.name, types[tt.name], tt.typ)
+		}
+		if found[tt.name] == 0 {
+			t.Errorf("%s: no samples", tt.name)
+		}
+		for _, s := range samples {
+			if family(s.name, types) == tt.name && labelNames(s.labels) != tt.labels {
+				t.Errorf("%s: labels = %q, want %q", s.name, labelNames(s.labels), tt.labels)
+			}
+		}
+	}
+	if len(types) != len(tests) {
+		t.Errorf("got %d metrics, want %d", len(types), len(tests))
+	}
+
+	want := map[string]bool{
+		`bronya_http_requests_total{code=4xx,method=other,vhost=` + vhost + `}`:    false,
+		`bronya_response_cache_requests_total{result=hit}`:                         false,
+		`bronya_response_cache_requests_total{result=miss}`:                        false,
+		`bronya_response_cache_requests_total{result=expired}`:                     false,
+		`bronya_response_cache_requests_total{result=stale}`:                       false,
+		`bronya_response_cache_requests_total{result=bypass}`:                      false,
+		`bronya_fastcgi_errors_total{stage=connect,upstream=tcp://127.0.0.1:9000}`: false,
+	}
+	for _, s := range samples {
+		keys := make([]string, 0, len(s.labels))
+		for k, v := range s.labels {
+			keys = append(keys, k+"="+v)
+		}
+		sort.Strings(keys)
+		key := s.name + "{" + strings.Join(keys, ",") + "}"
+		if _, ok := want[key]; ok {
+			want[key] = true
+		}
+	}
+	for key, ok := range want {
+		if !ok {
+			t.Errorf("missing sample %s", key)
+		}
+	}
+}
+
+func TestMetricsAccess(t *testing.T) {
+	tests := []struct {
+		allow  []string
+		client string
+		method string
+		code   int
+	}{
+		{nil, "192.0.2.1:1234", "GET", 200},
+		{nil, "192.0.2.1:1234", "HEAD", 200},
+		{nil, "192.0.2.1:1234", "POST", 405},
+		{[]string{"10.0.0.0/8"}, "10.1.2.3:1234", "GET", 200},
+		{[]string{"10.0.0.0/8"}, "192.0.2.1:1234", "GET", 403},
+		{[]string{"10.0.0.0/8"}, "@", "GET", 403},
+	}
+	for _, tt := range tests {
+		networks, err := netutil.ParseCIDRs(tt.allow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := config.Metrics{Allow: tt.allow, Networks: networks}
+		resp := MetricsHandler(conf, &Request{Method: tt.method, RemoteAddr: tt.client})
+		if resp.Code != tt.code {
+			t.Errorf("%s %s allow=%v: code = %d, want %d", tt.method, tt.client, tt.allow, resp.Code, tt.code)
+		}
+	}
+}
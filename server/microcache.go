@@ -0,0 +1,590 @@
+package server
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/logger"
+)
+
+// cacheEntry 是内存索引中的缓存条目，响应内容保存在磁盘上
+type cacheEntry struct {
+	Key                  string            `json:"key"`
+	URL                  string            `json:"url"`
+	Vhost                string            `json:"vhost"`
+	Code                 int               `json:"code"`
+	Headers              map[string]string `json:"headers"`
+	Stored               time.Time         `json:"stored"`
+	Expires              time.Time         `json:"expires"`
+	StaleWhileRevalidate time.Duration     `json:"stale_while_revalidate"`
+	StaleIfError         time.Duration     `json:"stale_if_error"`
+	Size                 int64             `json:"size"`
+	Tags                 []string          `json:"tags,omitempty"`
+
+	hash    string
+	element *list.Element
+}
+
+// cacheFill 表示正在向 FastCGI 请求的缓存条目，相同键的请求等待同一次请求的结果
+type cacheFill struct {
+	done chan struct{}
+	resp *Response
+}
+
+// responseCache 缓存 FastCGI 响应，索引保存在内存中，内容保存在磁盘上，超过容量时淘汰最久未使用的条目
+type responseCache struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	size    int64
+	entries map[string]*cacheEntry
+	lru     *list.List
+	pending map[string]*cacheFill
+	// generation 在每次清除缓存后递增，清除前开始的请求不再写入缓存
+	generation uint64
+
+	hits    uint64
+	misses  uint64
+	expired uint64
+	stale   uint64
+	bypass  uint64
+}
+
+// ResponseCacheStats 存储响应缓存的统计信息
+type ResponseCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Expired uint64
+	Stale   uint64
+	Bypass  uint64
+	Entries int
+	Size    int64
+	MaxSize int64
+}
+
+var responses = &responseCache{
+	entries: make(map[string]*cacheEntry),
+	lru:     list.New(),
+	pending: make(map[string]*cacheFill),
+}
+
+// ResponseCache 返回响应缓存的统计信息
+func ResponseCache() ResponseCacheStats {
+	responses.mutex.Lock()
+	defer responses.mutex.Unlock()
+	return ResponseCacheStats{
+		Hits:    atomic.LoadUint64(&responses.hits),
+		Misses:  atomic.LoadUint64(&responses.misses),
+		Expired: atomic.LoadUint64(&responses.expired),
+		Stale:   atomic.LoadUint64(&responses.stale),
+		Bypass:  atomic.LoadUint64(&responses.bypass),
+		Entries: len(responses.entries),
+		Size:    responses.size,
+		MaxSize: responses.maxSize,
+	}
+}
+
+// configure 应用新的缓存配置，缓存目录变化时从磁盘重建索引
+func (c *responseCache) configure(conf config.Cache) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.maxSize = conf.MaxSize
+	if c.path != conf.Path {
+		c.path = conf.Path
+		c.entries = make(map[string]*cacheEntry)
+		c.lru.Init()
+		c.size = 0
+		c.loadLocked()
+	}
+	c.evictLocked()
+}
+
+// loadLocked 读取缓存目录中每个文件的元数据，重建内存索引
+func (c *responseCache) loadLocked() {
+	paths, _ := filepath.Glob(filepath.Join(c.path, "*", "*"))
+	now := time.Now()
+	for _, p := range paths {
+		entry, err := readCacheMeta(p)
+		if err != nil || entry.hash != filepath.Base(p) || now.After(entry.Expires.Add(entry.staleFor())) {
+			os.Remove(p)
+			continue
+		}
+		entry.element = c.lru.PushFront(entry)
+		c.entries[entry.hash] = entry
+		c.size += entry.Size
+	}
+}
+
+func readCacheMeta(p string) (*cacheEntry, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(line, entry); err != nil {
+		return nil, err
+	}
+	entry.hash = hashKey(entry.Key)
+	return entry, nil
+}
+
+func (entry *cacheEntry) staleFor() time.Duration {
+	if entry.StaleIfError > entry.StaleWhileRevalidate {
+		return entry.StaleIfError
+	}
+	return entry.StaleWhileRevalidate
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *responseCache) file(hash string) string {
+	return filepath.Join(c.path, hash[:2], hash)
+}
+
+// serve 从缓存返回响应，未命中时请求 FastCGI 并缓存结果，响应带有 X-Cache 头部
+func (c *responseCache) serve(ctx *Context, file string) *Response {
+	resp, status := c.lookup(ctx, file)
+	// 统计按实际返回的 X-Cache 计数，与响应头部保持一致
+	switch status {
+	case "HIT":
+		atomic.AddUint64(&c.hits, 1)
+	case "MISS":
+		atomic.AddUint64(&c.misses, 1)
+	case "EXPIRED":
+		atomic.AddUint64(&c.expired, 1)
+	case "STALE":
+		atomic.AddUint64(&c.stale, 1)
+	case "BYPASS":
+		atomic.AddUint64(&c.bypass, 1)
+	}
+	// Surrogate-Key 只用于清除缓存，不发送给客户端
+	resp.DelHeader("Surrogate-Key")
+	resp.Header("X-Cache: " + status)
+	return resp
+}
+
+// lookup 查找或填充缓存，返回响应以及缓存状态
+func (c *responseCache) lookup(ctx *Context, file string) (*Response, string) {
+	if ctx.bypassCache() {
+		return ctx.fastcgi(file), "BYPASS"
+	}
+
+	key := ctx.cacheKey()
+	hash := hashKey(key)
+	now := time.Now()
+
+	c.mutex.Lock()
+	entry := c.entries[hash]
+	if entry != nil && now.Before(entry.Expires.Add(entry.StaleWhileRevalidate)) {
+		c.lru.MoveToFront(entry.element)
+		_, refreshing := c.pending[hash]
+		if now.After(entry.Expires) && !refreshing {
+			fill := &cacheFill{done: make(chan struct{})}
+			c.pending[hash] = fill
+			go c.refresh(ctx.background(), file, key, hash, c.generation, fill)
+		}
+		c.mutex.Unlock()
+
+		if resp, err := c.read(entry); err == nil {
+			if now.After(entry.Expires) {
+				return resp, "STALE"
+			}
+			return resp, "HIT"
+		}
+		c.mutex.Lock()
+		c.removeLocked(entry)
+		entry = nil
+	}
+
+	if fill, ok := c.pending[hash]; ok {
+		c.mutex.Unlock()
+		<-fill.done
+		if fill.resp == nil {
+			// 响应不能缓存时不能共享给其他请求，单独请求 FastCGI
+			return ctx.fastcgi(file), "MISS"
+		}
+		return fill.resp.clone(), "HIT"
+	}
+	fill := &cacheFill{done: make(chan struct{})}
+	c.pending[hash] = fill
+	generation := c.generation
+	c.mutex.Unlock()
+
+	status := "MISS"
+	if entry != nil {
+		status = "EXPIRED"
+	}
+	resp := ctx.fastcgi(file)
+	if resp.Code >= 500 && entry != nil && now.Before(entry.Expires.Add(entry.StaleIfError)) {
+		if stale, err := c.read(entry); err == nil {
+			resp, status = stale, "STALE"
+		}
+	} else if c.store(ctx, key, hash, generation, resp) {
+		fill.resp = resp.clone()
+	}
+	c.finish(hash, fill)
+	return resp, status
+}
+
+// refresh 在后台重新请求过期的条目
+func (c *responseCache) refresh(ctx *Context, file, key, hash string, generation uint64, fill *cacheFill) {
+	resp := ctx.fastcgi(file)
+	if resp.Code < 500 && c.store(ctx, key, hash, generation, resp) {
+		fill.resp = resp.clone()
+	}
+	c.finish(hash, fill)
+}
+
+func (c *responseCache) finish(hash string, fill *cacheFill) {
+	c.mutex.Lock()
+	delete(c.pending, hash)
+	c.mutex.Unlock()
+	close(fill.done)
+}
+
+// read 从磁盘读取缓存的响应内容
+func (c *responseCache) read(entry *cacheEntry) (*Response, error) {
+	content, err := ioutil.ReadFile(c.file(entry.hash))
+	if err != nil {
+		return nil, err
+	}
+	if i := strings.IndexByte(string(content), '\n'); i >= 0 {
+		content = content[i+1:]
+	}
+	resp := &Response{Code: entry.Code, Content: string(content), Headers: make(map[string]string)}
+	for k, v := range entry.Headers {
+		resp.Headers[k] = v
+	}
+	return resp, nil
+}
+
+// store 在响应可以缓存时写入磁盘并更新索引，generation 为开始请求 FastCGI 时的清除代数
+func (c *responseCache) store(ctx *Context, key, hash string, generation uint64, resp *Response) bool {
+	ttl, swr, sie, ok := cachePolicy(ctx.Vhost, resp)
+	if !ok {
+		return false
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		Key:                  key,
+		URL:                  ctx.requestURL(),
+		Vhost:                vhostName(ctx.Vhost),
+		Code:                 resp.Code,
+		Headers:              make(map[string]string),
+		Stored:               now,
+		Expires:              now.Add(ttl),
+		StaleWhileRevalidate: swr,
+		StaleIfError:         sie,
+		Size:                 int64(resp.Length()),
+		Tags:                 strings.Fields(resp.HeaderValue("Surrogate-Key")),
+		hash:                 hash,
+	}
+	for k, v := range resp.Headers {
+		if !strings.EqualFold(k, "Surrogate-Key") {
+			entry.Headers[k] = v
+		}
+	}
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		logger.Warning.Println(err)
+		return false
+	}
+
+	c.mutex.Lock()
+	dir, maxSize := filepath.Dir(c.file(hash)), c.maxSize
+	c.mutex.Unlock()
+	if entry.Size > maxSize {
+		return false
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		logger.Warning.Println("cache:", err)
+		return false
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		logger.Warning.Println("cache:", err)
+		return false
+	}
+	_, err = tmp.Write(append(append(meta, '\n'), resp.Bytes()...))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err == nil && generation != c.generation {
+		// 请求期间缓存被清除，响应可能已经过时
+		os.Remove(tmp.Name())
+		return false
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, hash))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logger.Warning.Println("cache:", err)
+		return false
+	}
+	if old, ok := c.entries[hash]; ok {
+		c.lru.Remove(old.element)
+		c.size -= old.Size
+	}
+	entry.element = c.lru.PushFront(entry)
+	c.entries[hash] = entry
+	c.size += entry.Size
+	c.evictLocked()
+	return true
+}
+
+func (c *responseCache) evictLocked() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+func (c *responseCache) removeLocked(entry *cacheEntry) {
+	if c.entries[entry.hash] != entry {
+		return
+	}
+	c.lru.Remove(entry.element)
+	delete(c.entries, entry.hash)
+	c.size -= entry.Size
+	os.Remove(c.file(entry.hash))
+}
+
+// cacheFilter 按条件选择缓存条目，为空的条件不参与匹配
+type cacheFilter struct {
+	Key    string
+	Prefix string
+	Vhost  string
+	Tag    string
+}
+
+func (f cacheFilter) empty() bool {
+	return f == cacheFilter{}
+}
+
+func (f cacheFilter) match(entry *cacheEntry) bool {
+	if f.Key != "" && entry.Key != f.Key {
+		return false
+	}
+	if f.Prefix != "" && !strings.HasPrefix(entry.URL, f.Prefix) {
+		return false
+	}
+	if f.Vhost != "" && !strings.EqualFold(entry.Vhost, f.Vhost) {
+		return false
+	}
+	if f.Tag != "" {
+		for _, tag := range entry.Tags {
+			if tag == f.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// purge 删除匹配的条目并返回删除的数量，正在请求 FastCGI 的响应不会再写入缓存
+func (c *responseCache) purge(f cacheFilter) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	if f.Key != "" {
+		entry := c.entries[hashKey(f.Key)]
+		if entry == nil || !f.match(entry) {
+			return 0
+		}
+		c.removeLocked(entry)
+		return 1
+	}
+	purged := 0
+	for _, entry := range c.entries {
+		if f.match(entry) {
+			c.removeLocked(entry)
+			purged++
+		}
+	}
+	return purged
+}
+
+// list 返回匹配条目的副本，按最近使用的顺序排列
+func (c *responseCache) list(f cacheFilter) []cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var entries []cacheEntry
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		if entry := e.Value.(*cacheEntry); f.match(entry) {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+// cachePolicy 根据响应头部计算缓存时间，不能缓存时 ok 为 false
+func cachePolicy(host *config.Vhost, resp *Response) (ttl, swr, sie time.Duration, ok bool) {
+	switch resp.Code {
+	case 200, 301, 302:
+	default:
+		return 0, 0, 0, false
+	}
+	if resp.HeaderValue("Set-Cookie") != "" || resp.HeaderValue("Content-Encoding") != "" {
+		return 0, 0, 0, false
+	}
+	for _, field := range strings.Split(resp.HeaderValue("Vary"), ",") {
+		if field = strings.TrimSpace(field); field != "" && !strings.EqualFold(field, "Accept-Encoding") {
+			return 0, 0, 0, false
+		}
+	}
+
+	ttl = time.Duration(host.Cache.TTL) * time.Second
+	swr = time.Duration(host.Cache.StaleWhileRevalidate) * time.Second
+	sie = time.Duration(host.Cache.StaleIfError) * time.Second
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(resp.HeaderValue("Cache-Control"), ",") {
+		name, value := strings.TrimSpace(directive), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+		seconds, err := strconv.Atoi(value)
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache", "private":
+			return 0, 0, 0, false
+		case "max-age":
+			if err == nil {
+				maxAge = seconds
+			}
+		case "s-maxage":
+			if err == nil {
+				sMaxAge = seconds
+			}
+		case "stale-while-revalidate":
+			if err == nil {
+				swr = time.Duration(seconds) * time.Second
+			}
+		case "stale-if-error":
+			if err == nil {
+				sie = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	switch {
+	case sMaxAge >= 0:
+		ttl = time.Duration(sMaxAge) * time.Second
+	case maxAge >= 0:
+		ttl = time.Duration(maxAge) * time.Second
+	case resp.HeaderValue("Expires") != "":
+		expires, err := http.ParseTime(resp.HeaderValue("Expires"))
+		if err != nil {
+			return 0, 0, 0, false
+		}
+		ttl = time.Until(expires)
+	}
+	return ttl, swr, sie, ttl > 0
+}
+
+// bypassCache 判断请求是否跳过缓存：非 GET/HEAD 请求、带有 Authorization 或匹配 bypass_cookies 的 Cookie
+func (ctx *Context) bypassCache() bool {
+	if ctx.Req.Method != "GET" && ctx.Req.Method != "HEAD" {
+		return true
+	}
+	if len(ctx.Req.HeaderValues("Authorization")) > 0 {
+		return true
+	}
+	for name := range ctx.Req.Cookies() {
+		for _, pattern := range ctx.Vhost.Cache.BypassCookies {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cacheKey 生成缓存键，虚拟主机、监听器和请求方法总在最前面，其余部分按照虚拟主机的配置生成。
+// 缓存由所有虚拟主机共用，这样不同虚拟主机的相同 URI、经默认虚拟主机到达的请求以及 HEAD 与 GET 不会共用条目
+func (ctx *Context) cacheKey() string {
+	parts := []string{
+		"vhost=" + strings.Join(ctx.Vhost.Name, ","),
+		"listener=" + ctx.Listener.Name,
+		"method=" + ctx.Req.Method,
+	}
+	for _, part := range ctx.Vhost.Cache.Key {
+		var value string
+		switch {
+		case part == "scheme":
+			value = ctx.scheme()
+		case part == "host":
+			value = strings.ToLower(ctx.Req.Host)
+		case part == "uri":
+			value = ctx.Req.RequestURI
+		case part == "path":
+			value = strings.SplitN(ctx.Req.RequestURI, "?", 2)[0]
+		case part == "query":
+			if i := strings.IndexByte(ctx.Req.RequestURI, '?'); i >= 0 {
+				value = ctx.Req.RequestURI[i+1:]
+			}
+		case part == "method":
+			value = ctx.Req.Method
+		case strings.HasPrefix(part, "header:"):
+			value = strings.Join(ctx.Req.HeaderValues(part[7:]), ", ")
+		case strings.HasPrefix(part, "cookie:"):
+			value = ctx.Req.Cookies()[part[7:]]
+		}
+		parts = append(parts, part+"="+value)
+	}
+	return strings.Join(parts, "|")
+}
+
+func (ctx *Context) scheme() string {
+	if ctx.Req.TLS {
+		return "https"
+	}
+	return "http"
+}
+
+// requestURL 返回请求的完整 URL
+func (ctx *Context) requestURL() string {
+	host := ctx.Req.Host
+	if ctx.Req.Port != "" {
+		host += ":" + ctx.Req.Port
+	}
+	return ctx.scheme() + "://" + host + ctx.Req.RequestURI
+}
+
+// background 复制 Context 用于后台刷新缓存
+func (ctx *Context) background() *Context {
+	req := *ctx.Req
+	return &Context{Vhost: ctx.Vhost, Listener: ctx.Listener, Req: &req, index: ctx.index, listing: ctx.listing}
+}
+
+func vhostName(host *config.Vhost) string {
+	if len(host.Name) == 0 {
+		return "default"
+	}
+	return host.Name[0]
+}
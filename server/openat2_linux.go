@@ -0,0 +1,65 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysOpenat2          = 437
+	resolveNoMagiclinks = 0x02
+	resolveNoSymlinks   = 0x04
+	resolveBeneath      = 0x08
+)
+
+var errNoOpenat2 = errors.New("openat2 is not supported")
+
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+// openBeneath 使用 openat2 打开 root 下的文件，内核会拒绝越过 root 的路径和符号链接
+func openBeneath(root, name string, noSymlinks bool) (*os.File, error) {
+	dir, err := os.Open(root)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	how := openHow{
+		flags:   syscall.O_RDONLY | syscall.O_CLOEXEC,
+		resolve: resolveBeneath | resolveNoMagiclinks,
+	}
+	if noSymlinks {
+		how.resolve |= resolveNoSymlinks
+	}
+	rel := strings.TrimPrefix(name, "/")
+	if rel == "" {
+		rel = "."
+	}
+	p, err := syscall.BytePtrFromString(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		fd, _, errno := syscall.Syscall6(sysOpenat2, dir.Fd(), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+		switch errno {
+		case 0:
+			return os.NewFile(fd, filepath.Join(root, rel)), nil
+		case syscall.EINTR, syscall.EAGAIN:
+			continue
+		case syscall.ENOSYS:
+			return nil, errNoOpenat2
+		}
+		return nil, &os.PathError{Op: "openat2", Path: filepath.Join(root, rel), Err: errno}
+	}
+}
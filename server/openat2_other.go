@@ -0,0 +1,15 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package server
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoOpenat2 = errors.New("openat2 is not supported")
+
+// openBeneath 在不支持 openat2 的平台上总是返回 errNoOpenat2
+func openBeneath(root, name string, noSymlinks bool) (*os.File, error) {
+	return nil, errNoOpenat2
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// WritePid 将当前进程的 pid 写入文件
+func WritePid(path string) error {
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// ReadPid 读取 pid 文件中的进程号
+func ReadPid(path string) (int, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+// removePid 删除 pid 文件，文件已被新进程改写时保留
+func removePid(path string) {
+	if pid, err := ReadPid(path); err == nil && pid == os.Getpid() {
+		os.Remove(path)
+	}
+}
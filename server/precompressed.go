@@ -0,0 +1,63 @@
+package server
+
+import (
+	"mime"
+	"path"
+
+	"github.com/kotoyuuko/bronya/logger"
+)
+
+// sidecarExtensions 预压缩文件的扩展名
+var sidecarExtensions = map[string]string{
+	"br":   ".br",
+	"zstd": ".zst",
+	"gzip": ".gz",
+}
+
+// precompressed 查找与请求文件对应且不早于原文件的预压缩文件，
+// 客户端接受其中某种编码时直接返回该文件；available 表示是否存在可用的预压缩文件
+func (ctx *Context) precompressed(file string) (resp *Response, available bool) {
+	_, fi, err := ctx.resolve(file)
+	if err != nil {
+		return nil, false
+	}
+
+	var encodings []string
+	for _, encoding := range ctx.Vhost.Compression.Encodings {
+		ext, ok := sidecarExtensions[encoding]
+		if !ok {
+			continue
+		}
+		_, sidecar, err := ctx.resolve(file + ext)
+		if err != nil || !sidecar.Mode().IsRegular() || sidecar.ModTime().Before(fi.ModTime()) {
+			continue
+		}
+		encodings = append(encodings, encoding)
+	}
+	if len(encodings) == 0 {
+		return nil, false
+	}
+
+	encoding := negotiateEncoding(ctx.Req.HeaderValues("Accept-Encoding"), encodings)
+	if _, ok := sidecarExtensions[encoding]; !ok {
+		return nil, true
+	}
+
+	f, err := ctx.open(file + sidecarExtensions[encoding])
+	if err != nil {
+		logger.Warning.Println(err)
+		return nil, true
+	}
+	defer f.Close()
+	content, err := f.ReadAll()
+	if err != nil {
+		logger.Warning.Println(err)
+		return nil, true
+	}
+
+	resp = &Response{Code: 200, Content: string(content)}
+	resp.Header("Content-Type: " + mime.TypeByExtension(path.Ext(file)))
+	resp.Header("Content-Encoding: " + encoding)
+	resp.AddVary("Accept-Encoding")
+	return resp, true
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/netutil"
+)
+
+// RealIP 根据可信代理传递的头部还原客户端地址
+type RealIP struct {
+	Header  string
+	Trusted []*net.IPNet
+}
+
+// realIPEntry 是配置快照与对应 RealIP 的组合
+type realIPEntry struct {
+	conf *config.RealIP
+	rip  *RealIP
+}
+
+// realIPs 缓存当前配置快照对应的 RealIP，重新加载配置后第一个请求会重新创建
+var realIPs atomic.Value
+
+// realIPFor 返回配置快照对应的 RealIP，同一份快照只创建一次
+func realIPFor(conf *config.RealIP) *RealIP {
+	if entry, ok := realIPs.Load().(*realIPEntry); ok && entry.conf == conf {
+		return entry.rip
+	}
+	rip := NewRealIP(*conf)
+	realIPs.Store(&realIPEntry{conf: conf, rip: rip})
+	return rip
+}
+
+// NewRealIP 根据配置创建 RealIP，既没有可信代理也没有指定头部时返回 nil
+func NewRealIP(conf config.RealIP) *RealIP {
+	if len(conf.Networks) == 0 && conf.Header == "" {
+		return nil
+	}
+	header := conf.Header
+	if header == "" {
+		header = "X-Forwarded-For"
+	}
+	return &RealIP{
+		Header:  header,
+		Trusted: conf.Networks,
+	}
+}
+
+// Resolve 从右向左遍历代理链，返回第一个不可信的地址。
+// 与 PROXY protocol 一致，Unix socket 上的对端是本机进程，总是可信
+func (rip *RealIP) Resolve(req *Request) string {
+	peer := req.PeerIP()
+	if net.ParseIP(peer) != nil && !rip.trusts(peer) {
+		return peer
+	}
+
+	var hops []string
+	for _, value := range req.HeaderValues(rip.Header) {
+		if strings.EqualFold(rip.Header, "Forwarded") {
+			hops = append(hops, forwardedFor(value)...)
+		} else {
+			for _, hop := range strings.Split(value, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == "" {
+			break
+		}
+		client = ip
+		if !rip.trusts(ip) {
+			break
+		}
+	}
+	return client
+}
+
+func (rip *RealIP) trusts(addr string) bool {
+	return netutil.ContainsIP(rip.Trusted, net.ParseIP(addr))
+}
+
+// forwardedFor 提取 RFC 7239 Forwarded 头部中的 for 参数
+func forwardedFor(value string) []string {
+	var hops []string
+	for _, element := range strings.Split(value, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				hops = append(hops, strings.Trim(kv[1], "\""))
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop 去掉端口和方括号，无法识别的地址返回空字符串
+func parseHop(hop string) string {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip.String()
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/netutil"
+)
+
+func TestRealIPResolve(t *testing.T) {
+	tests := []struct {
+		trusted []string
+		header  string
+		peer    string
+		value   string
+		want    string
+	}{
+		{trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.1:1234", value: "192.0.2.1", want: "192.0.2.1"},
+		{trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.1:1234", value: "192.0.2.1, 10.0.0.2", want: "192.0.2.1"},
+		{trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.1:1234", value: "198.51.100.1, 192.0.2.1", want: "192.0.2.1"},
+		{trusted: []string{"10.0.0.0/8"}, peer: "192.0.2.9:1234", value: "192.0.2.1", want: "192.0.2.9"},
+		{trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.1:1234", value: "garbage", want: "10.0.0.1"},
+		{trusted: []string{"10.0.0.0/8"}, header: "Forwarded", peer: "10.0.0.1:1234", value: `for="[2001:db8::1]:80"`, want: "2001:db8::1"},
+
+		// Unix socket 上的对端总是可信
+		{trusted: []string{"10.0.0.0/8"}, peer: "@", value: "192.0.2.1", want: "192.0.2.1"},
+		{header: "X-Real-IP", peer: "", value: "192.0.2.1", want: "192.0.2.1"},
+		{header: "X-Real-IP", peer: "127.0.0.1:1234", value: "192.0.2.1", want: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		networks, err := netutil.ParseCIDRs(tt.trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rip := NewRealIP(config.RealIP{Header: tt.header, Trusted: tt.trusted, Networks: networks})
+		if rip == nil {
+			t.Fatalf("NewRealIP(trusted=%v, header=%q) = nil", tt.trusted, tt.header)
+		}
+		req := &Request{RemoteAddr: tt.peer, Headers: []string{"GET / HTTP/1.1", rip.Header + ": " + tt.value}}
+		if got := rip.Resolve(req); got != tt.want {
+			t.Errorf("trusted=%v peer=%q %s: %q: Resolve = %q, want %q", tt.trusted, tt.peer, rip.Header, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRealIPFor(t *testing.T) {
+	if rip := realIPFor(&config.RealIP{}); rip != nil {
+		t.Errorf("realIPFor(empty) = %v, want nil", rip)
+	}
+	conf := &config.RealIP{Header: "X-Real-IP"}
+	if first, second := realIPFor(conf), realIPFor(conf); first == nil || first != second {
+		t.Errorf("realIPFor returned %p and %p for the same snapshot", first, second)
+	}
+}
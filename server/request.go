@@ -2,17 +2,24 @@ package server
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"io"
+	"net"
 	"strconv"
 	"strings"
-
-	"github.com/kotoyuuko/bronya/logger"
+	"time"
 )
 
 // Request 存储请求信息
 type Request struct {
 	ID         uint16
+	RequestID  string
 	Reader     *bufio.Reader
+	RemoteAddr string
+	RealIP     string
+	TLS        bool
 	Headers    []string
 	KeepConn   bool
 	Host       string
@@ -22,67 +29,192 @@ type Request struct {
 	Proto      string
 	File       string
 	Querys     string
-	Gzip       bool
 	Length     int
 	Body       string
+	Start      time.Time
+}
+
+// requestError 是需要回复错误响应并关闭连接的请求错误
+type requestError struct {
+	code int
+	msg  string
 }
 
-// ParseHeader 解析 HTTP 头部信息
-func (req *Request) ParseHeader() {
+func (e *requestError) Error() string {
+	return strconv.Itoa(e.code) + " " + e.msg
+}
+
+var (
+	errBadLength = &requestError{400, "Bad Request"}
+	errTooLarge  = &requestError{413, "Payload Too Large"}
+	// 不支持分块传输，继续读取会把请求内容当作下一个请求解析
+	errTransferEncoding = &requestError{501, "Not Implemented"}
+)
+
+// ParseHeader 解析 HTTP 头部信息，请求内容超过 maxBody 字节时返回 errTooLarge
+func (req *Request) ParseHeader(maxBody int64) error {
 	i := 0
+	length := ""
+	chunked := false
 	for {
-		if line, _, err := req.Reader.ReadLine(); err != io.EOF {
-			ln := string(line)
-
-			req.Headers = append(req.Headers, ln)
-			if i == 0 {
-				req.Method = strings.Fields(ln)[0]
-				req.RequestURI = strings.Fields(ln)[1]
-				req.Proto = strings.Fields(ln)[2]
-			}
-			if strings.HasPrefix(ln, "Host") {
-				hostWithPort := strings.Split(strings.Fields(ln)[1], ":")
-				req.Host = hostWithPort[0]
-				req.Port = hostWithPort[1]
+		line, _, err := req.Reader.ReadLine()
+		if err != nil {
+			return err
+		}
+		ln := string(line)
+
+		req.Headers = append(req.Headers, ln)
+		if i == 0 {
+			req.Start = time.Now()
+			fields := strings.Fields(ln)
+			if len(fields) != 3 {
+				return errors.New("malformed request line " + strconv.Quote(ln))
 			}
-			if strings.HasPrefix(ln, "Accept-Encoding") {
-				if strings.Index(ln, "gzip") > 0 {
-					req.Gzip = true
-				}
+			req.Method = fields[0]
+			req.RequestURI = fields[1]
+			req.Proto = fields[2]
+			req.KeepConn = req.Proto == "HTTP/1.1"
+			i++
+			continue
+		}
+		if ln == "" {
+			break
+		}
+		i++
+
+		splited := strings.SplitN(ln, ":", 2)
+		if len(splited) != 2 {
+			continue
+		}
+		name, value := strings.TrimSpace(splited[0]), strings.TrimSpace(splited[1])
+		switch strings.ToLower(name) {
+		case "host":
+			if host, port, err := net.SplitHostPort(value); err == nil {
+				req.Host = host
+				req.Port = port
+			} else {
+				req.Host = value
 			}
-			if strings.HasPrefix(ln, "Content-Length") {
-				req.Length, err = strconv.Atoi(strings.Fields(ln)[1])
-				if err != nil {
-					req.Length = 0
-				}
+		case "content-length":
+			if length != "" && length != value {
+				return errBadLength
 			}
-			if strings.Contains(ln, "keep-alive") {
+			length = value
+		case "transfer-encoding":
+			chunked = true
+		case "connection":
+			if strings.EqualFold(value, "keep-alive") {
 				req.KeepConn = true
+			} else if strings.EqualFold(value, "close") {
+				req.KeepConn = false
 			}
-			if ln == "" {
-				break
-			}
-			i++
-		} else {
-			break
 		}
 	}
-	uri := strings.Split(req.RequestURI, "?")
+	uri := strings.SplitN(req.RequestURI, "?", 2)
 	req.File = uri[0]
 	if len(uri) > 1 {
 		req.Querys = uri[1]
 	}
 
-	logger.Info.Println(req.Method, req.Host, req.Port, req.RequestURI)
+	if chunked {
+		return errTransferEncoding
+	}
+	if length != "" {
+		n, err := strconv.ParseInt(length, 10, 64)
+		if err != nil || strings.IndexFunc(length, isNotDigit) >= 0 {
+			return errBadLength
+		}
+		if maxBody > 0 && n > maxBody {
+			return errTooLarge
+		}
+		req.Length = int(n)
+	}
+	return nil
 }
 
-// ParseBody 解析 HTTP 包内容信息
-func (req *Request) ParseBody() {
-	for i := 0; i < req.Length; i++ {
-		b, err := req.Reader.ReadByte()
-		if err != nil {
-			break
+func isNotDigit(r rune) bool {
+	return r < '0' || r > '9'
+}
+
+// ParseBody 读取 Content-Length 指定长度的请求内容
+func (req *Request) ParseBody() error {
+	if req.Length == 0 {
+		return nil
+	}
+	body := make([]byte, req.Length)
+	if _, err := io.ReadFull(req.Reader, body); err != nil {
+		return err
+	}
+	req.Body = string(body)
+	return nil
+}
+
+// HeaderValues 返回指定名称的所有请求头部值
+func (req *Request) HeaderValues(name string) []string {
+	var values []string
+	if len(req.Headers) == 0 {
+		return values
+	}
+	for _, line := range req.Headers[1:] {
+		splited := strings.SplitN(line, ":", 2)
+		if len(splited) == 2 && strings.EqualFold(strings.TrimSpace(splited[0]), name) {
+			values = append(values, strings.TrimSpace(splited[1]))
 		}
-		req.Body += string(b)
 	}
+	return values
+}
+
+// PeerIP 返回 TCP 对端 IP 地址
+func (req *Request) PeerIP() string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ClientIP 返回客户端 IP 地址，经过可信代理时为还原后的地址
+func (req *Request) ClientIP() string {
+	if req.RealIP != "" {
+		return req.RealIP
+	}
+	return req.PeerIP()
+}
+
+// ClientPort 返回客户端端口，客户端地址经过还原时端口未知
+func (req *Request) ClientPort() string {
+	if req.RealIP != "" && req.RealIP != req.PeerIP() {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
+// Cookies 解析请求中的 Cookie
+func (req *Request) Cookies() map[string]string {
+	cookies := make(map[string]string)
+	for _, header := range req.HeaderValues("Cookie") {
+		for _, pair := range strings.Split(header, ";") {
+			splited := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if splited[0] == "" {
+				continue
+			}
+			if len(splited) == 2 {
+				cookies[splited[0]] = splited[1]
+			} else {
+				cookies[splited[0]] = ""
+			}
+		}
+	}
+	return cookies
+}
+
+// newRequestID 生成随机的请求 ID，用于关联错误日志和访问日志
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
 }
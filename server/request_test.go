@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaderBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		maxBody int64
+		err     error
+		body    string
+		rest    string
+	}{
+		{name: "no body", raw: "GET / HTTP/1.1\r\nHost: a.test\r\n\r\nGET /next", rest: "GET /next"},
+		{name: "content length", raw: "POST / HTTP/1.1\r\nContent-Length: 3\r\n\r\na=1GET /next", body: "a=1", rest: "GET /next"},
+		{name: "repeated equal length", raw: "POST / HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\na=1", body: "a=1"},
+		{name: "conflicting length", raw: "POST / HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\na=1", err: errBadLength},
+		{name: "negative length", raw: "POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n", err: errBadLength},
+		{name: "signed length", raw: "POST / HTTP/1.1\r\nContent-Length: +3\r\n\r\na=1", err: errBadLength},
+		{name: "invalid length", raw: "POST / HTTP/1.1\r\nContent-Length: 3x\r\n\r\na=1", err: errBadLength},
+		{name: "chunked", raw: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\na=1\r\n0\r\n\r\n", err: errTransferEncoding},
+		{name: "chunked with length", raw: "POST / HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n", err: errTransferEncoding},
+		{name: "too large", raw: "POST / HTTP/1.1\r\nContent-Length: 11\r\n\r\n", maxBody: 10, err: errTooLarge},
+		{name: "at limit", raw: "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789", maxBody: 10, body: "0123456789"},
+	}
+	for _, tt := range tests {
+		reader := bufio.NewReader(strings.NewReader(tt.raw))
+		req := &Request{Reader: reader}
+		err := req.ParseHeader(tt.maxBody)
+		if err != tt.err {
+			t.Errorf("%s: ParseHeader error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if err := req.ParseBody(); err != nil {
+			t.Errorf("%s: ParseBody error = %v", tt.name, err)
+			continue
+		}
+		rest := make([]byte, 64)
+		n, _ := reader.Read(rest)
+		if req.Body != tt.body || string(rest[:n]) != tt.rest {
+			t.Errorf("%s: body = %q, rest = %q, want %q, %q", tt.name, req.Body, rest[:n], tt.body, tt.rest)
+		}
+	}
+
+	req := &Request{Reader: bufio.NewReader(strings.NewReader("POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nab"))}
+	if err := req.ParseHeader(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := req.ParseBody(); err == nil {
+		t.Errorf("ParseBody on a truncated body succeeded with %q", req.Body)
+	}
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/kotoyuuko/bronya/logger"
+)
+
+var (
+	errBadPath   = errors.New("malformed request path")
+	errForbidden = errors.New("path is outside of the document root or denied by the symlink policy")
+)
+
+// openat2Unsupported 内核不支持 openat2 时置为 1，之后直接使用逐级检查
+var openat2Unsupported int32
+
+// cleanPath 解码并规范化请求路径，拒绝 NUL 字符以及越过根目录的 ..
+func cleanPath(raw string) (string, error) {
+	if !strings.HasPrefix(raw, "/") {
+		return "", errBadPath
+	}
+	decoded, err := url.PathUnescape(raw)
+	if err != nil || strings.IndexByte(decoded, 0) >= 0 {
+		return "", errBadPath
+	}
+
+	depth := 0
+	for _, segment := range strings.Split(decoded, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", errBadPath
+			}
+		default:
+			depth++
+		}
+	}
+	return cleanSlash(decoded), nil
+}
+
+// cleanSlash 规范化路径并保留结尾的 /
+func cleanSlash(p string) string {
+	clean := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// escapePath 对路径进行 URL 编码，用于 Location 等头部
+func escapePath(p string) string {
+	return (&url.URL{Path: p}).EscapedPath()
+}
+
+// escapeLocation 编码重定向目标中不能出现在 URL 里的字符，保留已有的 %XX 编码。
+// all 为 false 时（RewriteRule 的 NE 标志）只编码控制字符，CR、LF 在任何情况下都不会原样输出
+func escapeLocation(s string, all bool) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		escape := c < 0x20 || c == 0x7f
+		if all && !escape {
+			switch {
+			case c >= 0x80, c == ' ', strings.IndexByte("\"<>\\^`{|}", c) >= 0:
+				escape = true
+			case c == '%':
+				escape = i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2])
+			}
+		}
+		if escape {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// resolve 将 URL 路径解析为根目录下的真实路径，虚拟主机开启 file_cache 时使用缓存的结果
+func (ctx *Context) resolve(file string) (string, os.FileInfo, error) {
+	if ctx.Vhost.FileCache {
+		return files.resolve(ctx, file)
+	}
+	real, fi, _, err := ctx.walk(file)
+	return real, fi, err
+}
+
+// rootPath 将 resolve 返回的真实路径转换为相对根目录的路径
+func (ctx *Context) rootPath(real string) string {
+	root, err := filepath.EvalSymlinks(ctx.Vhost.Root)
+	if err != nil {
+		return filepath.ToSlash(real)
+	}
+	rel, err := filepath.Rel(root, real)
+	if err != nil {
+		return filepath.ToSlash(real)
+	}
+	return path.Clean("/" + filepath.ToSlash(rel))
+}
+
+// walk 逐级解析路径，符号链接按虚拟主机的策略处理，同时返回解析过程中读取过的目录
+func (ctx *Context) walk(file string) (string, os.FileInfo, []string, error) {
+	root, err := filepath.EvalSymlinks(ctx.Vhost.Root)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	current, dirs := root, []string{root}
+	for _, name := range strings.Split(file, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if name == ".." {
+			return "", nil, dirs, errForbidden
+		}
+		if current != dirs[len(dirs)-1] {
+			dirs = append(dirs, current)
+		}
+		next := filepath.Join(current, name)
+		if fi, err = os.Lstat(next); err != nil {
+			return "", nil, dirs, err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if next, err = ctx.followLink(root, next, fi); err != nil {
+				return "", nil, dirs, err
+			}
+			if fi, err = os.Stat(next); err != nil {
+				return "", nil, dirs, err
+			}
+		}
+		current = next
+	}
+	return current, fi, dirs, nil
+}
+
+// followLink 按 symlinks 策略解析符号链接：follow 允许指向根目录内的链接，
+// owner 还要求链接与目标的属主相同，deny 拒绝所有符号链接
+func (ctx *Context) followLink(root, link string, fi os.FileInfo) (string, error) {
+	if ctx.Vhost.Symlinks == "deny" {
+		return "", errForbidden
+	}
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return "", err
+	}
+	if !within(root, target) {
+		return "", errForbidden
+	}
+	if ctx.Vhost.Symlinks == "owner" {
+		tfi, err := os.Stat(target)
+		if err != nil {
+			return "", err
+		}
+		if owner(fi) != owner(tfi) {
+			return "", errForbidden
+		}
+	}
+	return target, nil
+}
+
+func owner(fi os.FileInfo) uint32 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid
+	}
+	return 0
+}
+
+// open 在根目录内打开文件，虚拟主机开启 file_cache 时复用已经打开的文件
+func (ctx *Context) open(file string) (*openFile, error) {
+	if ctx.Vhost.FileCache {
+		return files.open(ctx, file)
+	}
+	return ctx.openUncached(file)
+}
+
+// openUncached 在根目录内打开文件，Linux 上优先使用 openat2 的 RESOLVE_BENEATH
+func (ctx *Context) openUncached(file string) (*openFile, error) {
+	var f *os.File
+	var err error
+	if atomic.LoadInt32(&openat2Unsupported) == 0 && ctx.Vhost.Symlinks != "owner" {
+		var root string
+		if root, err = filepath.EvalSymlinks(ctx.Vhost.Root); err != nil {
+			return nil, err
+		}
+		f, err = openBeneath(root, file, ctx.Vhost.Symlinks == "deny")
+		if err == errNoOpenat2 {
+			atomic.StoreInt32(&openat2Unsupported, 1)
+		}
+	}
+	if f == nil && (err == nil || fallback(ctx.Vhost.Symlinks, err)) {
+		var real string
+		if real, _, _, err = ctx.walk(file); err != nil {
+			return nil, err
+		}
+		f, err = os.Open(real)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &openFile{file: f, info: fi, refs: 1}, nil
+}
+
+// fallback 判断 openat2 失败后是否改用逐级检查：内核不支持 openat2；openat2 被 seccomp 等策略拒绝；
+// 或者 follow 时遇到指向根目录内的绝对路径符号链接，RESOLVE_BENEATH 会拒绝这类链接而 walk 允许
+func fallback(symlinks string, err error) bool {
+	return err == errNoOpenat2 || errors.Is(err, syscall.EPERM) ||
+		symlinks != "deny" && errors.Is(err, syscall.EXDEV)
+}
+
+// openFile 存储打开的文件，开启 file_cache 时会被多个请求共享，因此只通过 ReadAt 读取
+type openFile struct {
+	file *os.File
+	info os.FileInfo
+	refs int32
+}
+
+// Name 返回文件路径
+func (f *openFile) Name() string {
+	return f.file.Name()
+}
+
+// Stat 返回打开文件时的文件信息
+func (f *openFile) Stat() os.FileInfo {
+	return f.info
+}
+
+// ReadAll 读取文件内容，长度以打开文件时的大小为准
+func (f *openFile) ReadAll() ([]byte, error) {
+	content := make([]byte, f.info.Size())
+	n, err := f.file.ReadAt(content, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return content[:n], err
+}
+
+// Close 释放文件，没有其他引用时关闭文件
+func (f *openFile) Close() {
+	if atomic.AddInt32(&f.refs, -1) == 0 {
+		f.file.Close()
+	}
+}
+
+// pathError 将路径解析错误转换为响应
+func pathError(file string, err error) *Response {
+	switch {
+	case os.IsNotExist(err), errors.Is(err, syscall.ENOTDIR):
+		return ErrorResponse(404, "Not Found")
+	case err == errBadPath:
+		return ErrorResponse(400, "Bad Request")
+	case err == errForbidden, errors.Is(err, syscall.EXDEV), errors.Is(err, syscall.ELOOP):
+		logger.Warning.Println("denied access to", file+":", err)
+		return ErrorResponse(403, "Forbidden")
+	case os.IsPermission(err):
+		return ErrorResponse(403, "Forbidden")
+	}
+	logger.Warning.Println(err)
+	return ErrorResponse(500, "Internal Server Error")
+}
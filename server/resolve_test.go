@@ -0,0 +1,314 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kotoyuuko/bronya/config"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		bad  bool
+	}{
+		{raw: "/", want: "/"},
+		{raw: "/index.html", want: "/index.html"},
+		{raw: "/a/./b//c/", want: "/a/b/c/"},
+		{raw: "/a/../b", want: "/b"},
+		{raw: "/a%20b.txt", want: "/a b.txt"},
+		{raw: "/a/%2e%2e/b", want: "/b"},
+		{raw: "/a%2fb", want: "/a/b"},
+		// 以 // 开头的目标仍是根目录下的路径
+		{raw: "//a.test/../etc/passwd", want: "/etc/passwd"},
+		{raw: "/..", bad: true},
+		{raw: "/../etc/passwd", bad: true},
+		{raw: "/a/../../etc/passwd", bad: true},
+		{raw: "/%2e%2e/etc/passwd", bad: true},
+		{raw: "/%2E%2E/etc/passwd", bad: true},
+		{raw: "/.%2e/etc/passwd", bad: true},
+		{raw: "/a%2f..%2f..%2fetc%2fpasswd", bad: true},
+		{raw: "/..%2fetc%2fpasswd", bad: true},
+		{raw: "/index.php%00.txt", bad: true},
+		{raw: "/%00", bad: true},
+		{raw: "/%zz", bad: true},
+		{raw: "/%2", bad: true},
+		{raw: "", bad: true},
+		{raw: "index.html", bad: true},
+		{raw: "http://a.test/etc/passwd", bad: true},
+		{raw: "*", bad: true},
+	}
+	for _, tt := range tests {
+		got, err := cleanPath(tt.raw)
+		if tt.bad {
+			if err != errBadPath {
+				t.Errorf("cleanPath(%q) = %q, %v, want errBadPath", tt.raw, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("cleanPath(%q) = %q, %v, want %q", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+// resolveTest 是一个路径解析用例，want 为根目录下的真实路径，code 为 pathError 对应的状态码
+type resolveTest struct {
+	file     string
+	symlinks string
+	want     string
+	code     int
+	needRoot bool
+}
+
+var resolveTests = []resolveTest{
+	{file: "/", want: ".", code: 200},
+	{file: "/index.html", want: "index.html", code: 200},
+	{file: "/sub/file.txt", want: "sub/file.txt", code: 200},
+	{file: "/missing", code: 404},
+	{file: "/index.html/x", code: 404},
+	{file: "/../outside.txt", code: 403},
+	{file: "/sub/../../outside.txt", code: 403},
+
+	// 指向根目录内的符号链接
+	{file: "/in", symlinks: "follow", want: "sub/file.txt", code: 200},
+	{file: "/in", symlinks: "", want: "sub/file.txt", code: 200},
+	{file: "/dir/file.txt", symlinks: "follow", want: "sub/file.txt", code: 200},
+	{file: "/sub/up/index.html", symlinks: "follow", want: "index.html", code: 200},
+	{file: "/abs", symlinks: "follow", want: "sub/file.txt", code: 200},
+	{file: "/abs", symlinks: "", want: "sub/file.txt", code: 200},
+	{file: "/abs", symlinks: "owner", want: "sub/file.txt", code: 200},
+	{file: "/abs", symlinks: "deny", code: 403},
+
+	// 指向根目录外的符号链接
+	{file: "/etc/passwd", symlinks: "follow", code: 403},
+	{file: "/passwd", symlinks: "follow", code: 403},
+	{file: "/parent/outside.txt", symlinks: "follow", code: 403},
+	{file: "/out", symlinks: "follow", code: 403},
+	{file: "/etc/passwd", symlinks: "owner", code: 403},
+	{file: "/parent/outside.txt", symlinks: "owner", code: 403},
+
+	// owner 要求链接与目标属主相同
+	{file: "/in", symlinks: "owner", want: "sub/file.txt", code: 200},
+	{file: "/dir/file.txt", symlinks: "owner", want: "sub/file.txt", code: 200},
+	{file: "/other", symlinks: "owner", code: 403, needRoot: true},
+	{file: "/other", symlinks: "follow", want: "sub/file.txt", code: 200},
+
+	// deny 拒绝所有符号链接
+	{file: "/index.html", symlinks: "deny", want: "index.html", code: 200},
+	{file: "/in", symlinks: "deny", code: 403},
+	{file: "/dir/file.txt", symlinks: "deny", code: 403},
+	{file: "/sub/up/index.html", symlinks: "deny", code: 403},
+	{file: "/etc/passwd", symlinks: "deny", code: 403},
+}
+
+// newResolveRoot 创建测试用的网站根目录，根目录的上一级放置一个根目录外的文件
+func newResolveRoot(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	for _, dir := range []string{root, filepath.Join(root, "sub")} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range map[string]string{
+		filepath.Join(base, "outside.txt"):     "outside",
+		filepath.Join(root, "index.html"):      "index",
+		filepath.Join(root, "sub", "file.txt"): "file",
+	} {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{
+		"in":     "sub/file.txt",
+		"dir":    "sub",
+		"sub/up": "..",
+		"etc":    "/etc",
+		"passwd": "/etc/passwd",
+		"parent": "..",
+		"out":    "../outside.txt",
+		"other":  "sub/file.txt",
+		"abs":    filepath.Join(root, "sub", "file.txt"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(filepath.Join(root, "other"), 65534, 65534); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func newResolveContext(root, symlinks string) *Context {
+	return &Context{Vhost: &config.Vhost{Root: root, Symlinks: symlinks}}
+}
+
+// resultCode 将解析结果转换为状态码，与请求处理时的行为一致
+func resultCode(file string, err error) int {
+	if err == nil {
+		return 200
+	}
+	return pathError(file, err).Code
+}
+
+func TestWalk(t *testing.T) {
+	root := newResolveRoot(t)
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range resolveTests {
+		if tt.needRoot && os.Geteuid() != 0 {
+			continue
+		}
+		got, fi, _, err := newResolveContext(root, tt.symlinks).walk(tt.file)
+		if code := resultCode(tt.file, err); code != tt.code {
+			t.Errorf("walk(%q) symlinks=%q: code = %d (%v), want %d", tt.file, tt.symlinks, code, err, tt.code)
+			continue
+		}
+		if tt.code != 200 {
+			continue
+		}
+		if want := filepath.Join(real, tt.want); got != want {
+			t.Errorf("walk(%q) symlinks=%q = %q, want %q", tt.file, tt.symlinks, got, want)
+		}
+		if fi == nil || fi.Mode()&os.ModeSymlink != 0 {
+			t.Errorf("walk(%q) symlinks=%q: file info %v is not the target's", tt.file, tt.symlinks, fi)
+		}
+	}
+}
+
+func TestOpenUncached(t *testing.T) {
+	root := newResolveRoot(t)
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modes := []struct {
+		name        string
+		unsupported int32
+	}{
+		{"openat2", 0},
+		{"fallback", 1},
+	}
+	saved := atomic.LoadInt32(&openat2Unsupported)
+	defer atomic.StoreInt32(&openat2Unsupported, saved)
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			if mode.unsupported == 0 {
+				f, err := openBeneath(real, "/", false)
+				if err == errNoOpenat2 {
+					t.Skip("openat2 is not available")
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+			}
+
+			for _, tt := range resolveTests {
+				if tt.needRoot && os.Geteuid() != 0 {
+					continue
+				}
+				atomic.StoreInt32(&openat2Unsupported, mode.unsupported)
+				f, err := newResolveContext(root, tt.symlinks).openUncached(tt.file)
+				if atomic.LoadInt32(&openat2Unsupported) != mode.unsupported {
+					t.Fatalf("openUncached(%q) changed openat2Unsupported", tt.file)
+				}
+				if code := resultCode(tt.file, err); code != tt.code {
+					t.Errorf("openUncached(%q) symlinks=%q: code = %d (%v), want %d", tt.file, tt.symlinks, code, err, tt.code)
+					if f != nil {
+						f.Close()
+					}
+					continue
+				}
+				if tt.code != 200 {
+					continue
+				}
+				want, err := os.Stat(filepath.Join(real, tt.want))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !os.SameFile(f.Stat(), want) {
+					t.Errorf("openUncached(%q) symlinks=%q opened %s, want %s", tt.file, tt.symlinks, f.Name(), tt.want)
+				}
+				f.Close()
+			}
+		})
+	}
+}
+
+// newDenyVhost 创建包含敏感文件以及指向它们的符号链接的虚拟主机
+func newDenyVhost(t *testing.T) *config.Vhost {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		".env":       "SECRET=1",
+		".htpasswd":  "user:hash",
+		"dump.sql":   "DROP TABLE",
+		"config.inc": "<?php",
+		"page.html":  "page",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{
+		"env.txt":    ".env",
+		"passwd.txt": ".htpasswd",
+		"dump.txt":   "dump.sql",
+		"config.txt": "config.inc",
+		"link.html":  "page.html",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vhost := &config.Vhost{Root: root}
+	vhost.Deny.Status = 403
+	for _, pattern := range []string{".*", "!.well-known", "*.sql"} {
+		rule, err := config.ParseDenyRule(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vhost.Deny.Rules = append(vhost.Deny.Rules, rule)
+	}
+	return vhost
+}
+
+func TestServeFileDenied(t *testing.T) {
+	vhost := newDenyVhost(t)
+	tests := []struct {
+		file   string
+		index  []string
+		denied bool
+	}{
+		{file: "/.env", denied: true},
+		{file: "/DUMP.SQL", denied: true},
+		{file: "/env.txt", denied: true},
+		{file: "/passwd.txt", denied: true},
+		{file: "/dump.txt", denied: true},
+		{file: "/config.txt", denied: true},
+		{file: "/", index: []string{"dump.sql"}, denied: true},
+		{file: "/", index: []string{"env.txt"}, denied: true},
+		{file: "/link.html"},
+		{file: "/", index: []string{"link.html"}},
+	}
+	for _, tt := range tests {
+		ctx := &Context{Vhost: vhost, Req: &Request{File: tt.file}, index: tt.index}
+		if denied := ctx.serveFile().Code == 403; denied != tt.denied {
+			t.Errorf("serveFile(%q) index=%q: denied = %v, want %v", tt.file, tt.index, denied, tt.denied)
+		}
+	}
+}
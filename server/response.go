@@ -1,19 +1,20 @@
 package server
 
 import (
-	"bytes"
-	"compress/gzip"
 	"net"
 	"strconv"
 	"strings"
+
+	"github.com/kotoyuuko/bronya/logger"
 )
 
 // Response 存储响应信息
 type Response struct {
 	Code    int
-	Gzip    bool
 	Headers map[string]string
 	Content string
+
+	source *assetSource
 }
 
 // Bytes 将响应内容转换为 Bytes 数组
@@ -31,36 +32,99 @@ func (resp *Response) Header(header string) {
 	if resp.Headers == nil {
 		resp.Headers = make(map[string]string)
 	}
-	splited := strings.Split(header, ":")
+	splited := strings.SplitN(header, ":", 2)
+	if len(splited) != 2 || !validHeader(splited[0], splited[1]) {
+		logger.Warning.Log("invalid response header dropped", "header", header)
+		return
+	}
 	resp.Headers[strings.Trim(splited[0], " ")] = strings.Trim(splited[1], " ")
 }
 
-// GzipEncode 使用 Gzip 算法压缩响应内容
-func (resp *Response) GzipEncode() {
-	var buffer bytes.Buffer
-	gz := gzip.NewWriter(&buffer)
-	gz.Write([]byte(resp.Content))
-	gz.Flush()
-	gz.Close()
-	resp.Content = string(buffer.Bytes())
-	resp.Gzip = true
+// validHeader 检查头部名称和值中是否包含 CR、LF 等可以拆分响应的字符
+func validHeader(name, value string) bool {
+	return name != "" && !strings.ContainsAny(name, "\r\n:") && !strings.ContainsAny(value, "\r\n")
 }
 
-// DoResponse 发送响应
-func DoResponse(conn net.Conn, resp *Response) {
-	respPkg := "HTTP/1.1 " + strconv.Itoa(resp.Code) + " " + HTTPStatusCode[resp.Code] + "\r\n"
-	respPkg += "Content-Length: " + strconv.Itoa(resp.Length()) + "\r\n"
+// clone 复制响应，避免共享的 Headers 被修改
+func (resp *Response) clone() *Response {
+	c := *resp
+	c.Headers = make(map[string]string, len(resp.Headers))
+	for k, v := range resp.Headers {
+		c.Headers[k] = v
+	}
+	return &c
+}
+
+// HeaderValue 返回响应头部的值，名称不区分大小写
+func (resp *Response) HeaderValue(name string) string {
+	for key, value := range resp.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
 
-	if resp.Gzip {
-		respPkg += "Content-Encoding: gzip\r\n"
+// DelHeader 删除响应头部，名称不区分大小写
+func (resp *Response) DelHeader(name string) {
+	for key := range resp.Headers {
+		if strings.EqualFold(key, name) {
+			delete(resp.Headers, key)
+		}
 	}
+}
+
+// AddVary 向 Vary 头部追加字段
+func (resp *Response) AddVary(field string) {
+	for key, value := range resp.Headers {
+		if !strings.EqualFold(key, "Vary") {
+			continue
+		}
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), field) || strings.TrimSpace(v) == "*" {
+				return
+			}
+		}
+		resp.Headers[key] = value + ", " + field
+		return
+	}
+	resp.Header("Vary: " + field)
+}
+
+// Encode 使用指定的算法压缩响应内容，支持 gzip、deflate、br 和 zstd
+func (resp *Response) Encode(encoding string) error {
+	var content []byte
+	var err error
+	if resp.source != nil {
+		content, err = assets.encode(resp.source, encoding, resp.Bytes())
+	} else {
+		content, err = encodeContent(encoding, resp.Bytes())
+	}
+	if err != nil {
+		return err
+	}
+	resp.Content = string(content)
+	resp.Header("Content-Encoding: " + encoding)
+	return nil
+}
+
+// DoResponse 发送响应，返回写入的字节数
+func DoResponse(conn net.Conn, resp *Response) int {
+	respPkg := "HTTP/1.1 " + strconv.Itoa(resp.Code) + " " + HTTPStatusCode[resp.Code] + "\r\n"
+	respPkg += "Content-Length: " + strconv.Itoa(resp.Length()) + "\r\n"
 
 	for key, value := range resp.Headers {
+		// 通过 Headers 直接写入的头部同样需要检查
+		if !validHeader(key, value) {
+			logger.Warning.Log("invalid response header dropped", "header", key)
+			continue
+		}
 		respPkg += key + ": " + value + "\r\n"
 	}
 
 	respPkg += "\r\n"
-	respPkg += resp.Content + "\r\n"
+	respPkg += resp.Content
 
-	conn.Write([]byte(respPkg))
+	n, _ := conn.Write([]byte(respPkg))
+	return n
 }
@@ -1,30 +1,436 @@
 package server
 
 import (
+	"crypto/tls"
+	"errors"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/kotoyuuko/bronya/config"
 	"github.com/kotoyuuko/bronya/logger"
+	"github.com/kotoyuuko/bronya/proxyproto"
 )
 
+// Version Bronya 版本号
+var Version = "1.0.0"
+
+// shutdownHeaderTimeout 关闭服务器时等待正在读取的请求头部的最长时间
+const shutdownHeaderTimeout = 5 * time.Second
+
+// ErrServerClosed 服务器已经关闭
+var ErrServerClosed = errors.New("server: Server closed")
+
+// Server 管理监听器以及其上的连接
+type Server struct {
+	PidFile string
+
+	mutex     sync.Mutex
+	listeners map[string]*listener
+	conns     map[*conn]struct{}
+	closing   bool
+	done      chan struct{}
+	doneOnce  sync.Once
+}
+
+// New 创建服务器
+func New() *Server {
+	return &Server{
+		listeners: make(map[string]*listener),
+		conns:     make(map[*conn]struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
 // Fire 重装小兔-19C
-func Fire() {
-	listen(config.Config.Listen, config.Config.Port)
+func Fire(pidFile string) error {
+	srv := New()
+	srv.PidFile = pidFile
+	go handleSignals(srv)
+
+	if err := srv.Fire(); err != ErrServerClosed {
+		return err
+	}
+	logger.Info.Println("Bronya stopped.")
+	return nil
+}
+
+// Fire 打开所有监听器并开始服务，直到服务器被关闭
+func (srv *Server) Fire() error {
+	srv.mutex.Lock()
+	if srv.closing {
+		srv.mutex.Unlock()
+		return ErrServerClosed
+	}
+	assets.configure(config.Current().AssetCache)
+	files.configure(config.Current().FileCache)
+	responses.configure(config.Current().Cache)
+	accessLogs.configure(config.Current().AccessLogs())
+	opened, err := srv.openListenersLocked(config.Current().Listeners)
+	if err != nil {
+		srv.mutex.Unlock()
+		return err
+	}
+	srv.serveListenersLocked(config.Current().Listeners, opened)
+	srv.mutex.Unlock()
+
+	closeInherited()
+	if srv.PidFile != "" {
+		if err := WritePid(srv.PidFile); err != nil {
+			logger.Warning.Println(err)
+		}
+		defer removePid(srv.PidFile)
+	}
+	notifyReady()
+
+	<-srv.done
+	accessLogs.close()
+	return ErrServerClosed
+}
+
+// Reload 重新加载配置文件。新增的监听器全部打开后才替换当前配置并更新缓存与日志，
+// 任一监听器打开失败时保留原来的配置和监听器
+func (srv *Server) Reload() error {
+	conf, warnings, err := config.Load(config.Path)
+	for _, w := range warnings.Warnings() {
+		logger.Warning.Println(w)
+	}
+	if err != nil {
+		return err
+	}
+
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if srv.closing {
+		return ErrServerClosed
+	}
+	opened, err := srv.openListenersLocked(conf.Listeners)
+	if err != nil {
+		return err
+	}
+
+	config.Store(conf)
+	if err := logger.Init(LogOptions(conf.Log)); err != nil {
+		logger.Error.Println("Keeping the old log outputs:", err)
+	}
+	assets.configure(conf.AssetCache)
+	files.configure(conf.FileCache)
+	responses.configure(conf.Cache)
+	accessLogs.configure(conf.AccessLogs())
+	srv.serveListenersLocked(conf.Listeners, opened)
+	return nil
+}
+
+// openListenersLocked 打开 lns 中新增的监听器但不开始服务，任一监听器打开失败时关闭所有已打开的监听器。
+// 地址与现有监听器相同时复制原来的 socket，不需要先关闭现有的监听器
+func (srv *Server) openListenersLocked(lns []config.Listener) ([]*listener, error) {
+	var opened []*listener
+	var errs []string
+	for i := range lns {
+		ln := &lns[i]
+		if _, ok := srv.listeners[ln.Identity()]; ok {
+			continue
+		}
+
+		var raw, nl net.Listener
+		var err error
+		if old := srv.listenerAtLocked(ln); old != nil {
+			raw, nl, err = reuseListener(old.raw, ln)
+		} else {
+			raw, nl, err = listen(ln)
+		}
+		if err != nil {
+			errs = append(errs, ln.Name+": "+err.Error())
+			continue
+		}
+		l := &listener{Listener: nl, raw: raw}
+		l.setConf(ln)
+		opened = append(opened, l)
+	}
+
+	if len(errs) > 0 {
+		for _, l := range opened {
+			l.Close()
+		}
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+	return opened, nil
+}
+
+// serveListenersLocked 关闭 lns 中已移除的监听器，更新保留的监听器的配置，
+// 并开始在 openListenersLocked 打开的监听器上服务
+func (srv *Server) serveListenersLocked(lns []config.Listener, opened []*listener) {
+	wanted := make(map[string]*config.Listener)
+	for i := range lns {
+		wanted[lns[i].Identity()] = &lns[i]
+	}
+
+	for key, l := range srv.listeners {
+		if ln, ok := wanted[key]; ok {
+			l.setConf(ln)
+			continue
+		}
+		logger.Info.Println("Closing listener", l.conf().Name, l.conf().Network()+"://"+l.conf().Addr())
+		if ul, ok := l.raw.(*net.UnixListener); ok {
+			if o := reusedBy(l, opened); o != nil {
+				// socket 文件由新的监听器继续使用，关闭时改由新的监听器删除
+				ul.SetUnlinkOnClose(false)
+				o.raw.(*net.UnixListener).SetUnlinkOnClose(true)
+			}
+		}
+		l.Close()
+		delete(srv.listeners, key)
+	}
+
+	for _, l := range opened {
+		ln := l.conf()
+		srv.listeners[ln.Identity()] = l
+		logger.Info.Println("Listening on", ln.Name, ln.Network()+"://"+ln.Addr())
+		go srv.serve(l)
+	}
+}
+
+// listenerAtLocked 返回与 ln 监听同一地址的现有监听器
+func (srv *Server) listenerAtLocked(ln *config.Listener) *listener {
+	for _, l := range srv.listeners {
+		if l.conf().Network() == ln.Network() && l.conf().Addr() == ln.Addr() {
+			return l
+		}
+	}
+	return nil
+}
+
+// reusedBy 返回复制了 l 的 socket 的新监听器
+func reusedBy(l *listener, opened []*listener) *listener {
+	for _, o := range opened {
+		if o.conf().Network() == l.conf().Network() && o.conf().Addr() == l.conf().Addr() {
+			return o
+		}
+	}
+	return nil
+}
+
+// reuseListener 复制现有监听器的 socket 并按新配置包装，用于同一地址上协议、证书等设置的变化
+func reuseListener(old net.Listener, ln *config.Listener) (net.Listener, net.Listener, error) {
+	fl, ok := old.(filer)
+	if !ok {
+		return nil, nil, errors.New("cannot reuse the socket of " + ln.Addr())
+	}
+	f, err := fl.File()
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := chmodSocket(ln); err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+
+	listener, err := wrapListener(raw, ln)
+	if err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+	return raw, listener, nil
+}
+
+// Shutdown 停止接受新连接，关闭空闲连接并等待活动请求完成，
+// 超过 timeout 后强制关闭剩余连接
+func (srv *Server) Shutdown(timeout time.Duration) error {
+	srv.mutex.Lock()
+	srv.closing = true
+	srv.closeListenersLocked()
+	srv.mutex.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdleConns() == 0 {
+			srv.finish()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			srv.Close()
+			return errors.New("server: shutdown deadline exceeded")
+		}
+		<-ticker.C
+	}
+}
+
+// Close 立即关闭所有监听器和连接
+func (srv *Server) Close() error {
+	srv.mutex.Lock()
+	srv.closing = true
+	srv.closeListenersLocked()
+	for c := range srv.conns {
+		c.Close()
+		delete(srv.conns, c)
+	}
+	srv.mutex.Unlock()
+
+	srv.finish()
+	return nil
+}
+
+func (srv *Server) finish() {
+	srv.doneOnce.Do(func() {
+		close(srv.done)
+	})
+}
+
+func (srv *Server) shuttingDown() bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.closing
+}
+
+func (srv *Server) closeListenersLocked() {
+	for key, l := range srv.listeners {
+		l.Close()
+		delete(srv.listeners, key)
+	}
+}
+
+// closeIdleConns 关闭空闲连接并返回剩余的连接数。正在读取请求头部的连接视为处理中的请求，
+// 但读取超时缩短为 shutdownHeaderTimeout，避免慢速客户端拖住关闭
+func (srv *Server) closeIdleConns() int {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for c := range srv.conns {
+		switch c.getState() {
+		case stateNew, stateIdle:
+			c.Close()
+			delete(srv.conns, c)
+		case stateReading:
+			c.drain(time.Now().Add(shutdownHeaderTimeout))
+		}
+	}
+	return len(srv.conns)
+}
+
+func (srv *Server) trackConn(c *conn, add bool) bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if add {
+		if srv.closing {
+			return false
+		}
+		srv.conns[c] = struct{}{}
+	} else {
+		delete(srv.conns, c)
+	}
+	return true
 }
 
-func listen(addr, port string) {
-	listener, err := net.Listen("tcp", addr+":"+port)
+// listen 打开监听器，返回原始 socket 监听器以及按配置包装后的监听器
+func listen(ln *config.Listener) (net.Listener, net.Listener, error) {
+	raw := takeInherited(ln)
+	if raw == nil {
+		var err error
+		raw, err = listenSocket(ln)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	listener, err := wrapListener(raw, ln)
+	if err != nil {
+		raw.Close()
+		return nil, nil, err
+	}
+	return raw, listener, nil
+}
+
+func listenSocket(ln *config.Listener) (net.Listener, error) {
+	if ln.Network() == "unix" {
+		// 清理上次运行遗留的 socket 文件
+		if _, err := os.Stat(ln.Socket); err == nil {
+			os.Remove(ln.Socket)
+		}
+	}
+
+	listener, err := net.Listen(ln.Network(), ln.Addr())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chmodSocket(ln); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// chmodSocket 按配置修改 Unix socket 文件的权限
+func chmodSocket(ln *config.Listener) error {
+	if ln.Network() != "unix" || ln.Mode == "" {
+		return nil
+	}
+	mode, err := strconv.ParseUint(ln.Mode, 8, 32)
 	if err != nil {
-		logger.Error.Fatalln(err)
+		return err
+	}
+	return os.Chmod(ln.Socket, os.FileMode(mode))
+}
+
+// wrapListener 按配置在原始监听器上叠加 PROXY 协议与 TLS
+func wrapListener(listener net.Listener, ln *config.Listener) (net.Listener, error) {
+	if ln.Proxy.Enable {
+		timeout := time.Duration(ln.Proxy.Timeout) * time.Second
+		if timeout == 0 {
+			timeout = 5 * time.Second
+		}
+		pl, err := proxyproto.NewListener(listener, ln.Proxy.Trusted, timeout)
+		if err != nil {
+			return nil, err
+		}
+		listener = pl
 	}
-	defer listener.Close()
 
+	if ln.TLS() {
+		cert, err := tls.LoadX509KeyPair(ln.Cert, ln.Key)
+		if err != nil {
+			return nil, err
+		}
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		})
+	}
+
+	return listener, nil
+}
+
+func (srv *Server) serve(l *listener) {
 	for {
-		conn, err := listener.Accept()
+		rwc, err := l.Accept()
 		if err != nil {
+			if srv.shuttingDown() || l.isClosed() {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
 			logger.Error.Println(err)
+			return
 		}
 
-		go Handler(conn)
+		c := &conn{
+			Conn: rwc,
+			ln:   l.conf(),
+		}
+		if !srv.trackConn(c, true) {
+			rwc.Close()
+			continue
+		}
+		go srv.handle(c)
 	}
 }
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"encoding/json"
+	"html"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/logger"
+	"github.com/kotoyuuko/bronya/netutil"
+)
+
+// activeRequest 是正在处理的请求，upstream 为正在等待的 FastCGI 地址
+type activeRequest struct {
+	req      *Request
+	vhost    string
+	listener string
+	upstream atomic.Value
+}
+
+// activeRequests 记录正在处理的请求，用于状态页
+type activeRequests struct {
+	mutex    sync.Mutex
+	requests map[*Request]*activeRequest
+}
+
+var inflight = &activeRequests{requests: make(map[*Request]*activeRequest)}
+
+func (a *activeRequests) add(req *Request, ln *config.Listener, vhost *config.Vhost) {
+	r := &activeRequest{req: req, listener: ln.Name}
+	if vhost != nil {
+		r.vhost = vhostName(vhost)
+	}
+	r.upstream.Store("")
+	a.mutex.Lock()
+	a.requests[req] = r
+	a.mutex.Unlock()
+}
+
+func (a *activeRequests) remove(req *Request) {
+	a.mutex.Lock()
+	delete(a.requests, req)
+	a.mutex.Unlock()
+}
+
+// upstream 标记请求正在等待 FastCGI，返回的函数在 FastCGI 请求结束时调用
+func (a *activeRequests) upstream(req *Request, upstream string) func() {
+	a.mutex.Lock()
+	r := a.requests[req]
+	a.mutex.Unlock()
+	if r == nil {
+		// 后台刷新缓存的请求不在列表中
+		return func() {}
+	}
+	r.upstream.Store(upstream)
+	return func() { r.upstream.Store("") }
+}
+
+func (a *activeRequests) list() []*activeRequest {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	list := make([]*activeRequest, 0, len(a.requests))
+	for _, r := range a.requests {
+		list = append(list, r)
+	}
+	return list
+}
+
+// statusReport 是状态页的内容
+type statusReport struct {
+	Version     string          `json:"version"`
+	Start       time.Time       `json:"start"`
+	Uptime      int64           `json:"uptime"`
+	Generation  uint64          `json:"generation"`
+	Connections statusConns     `json:"connections"`
+	Vhosts      []statusVhost   `json:"vhosts"`
+	Requests    []statusRequest `json:"requests"`
+}
+
+// statusConns 按状态统计的连接数，Upstream 为正在等待 FastCGI 的连接，不计入 Writing
+type statusConns struct {
+	Accepted uint64 `json:"accepted"`
+	Active   int64  `json:"active"`
+	Reading  int64  `json:"reading"`
+	Writing  int64  `json:"writing"`
+	Upstream int64  `json:"upstream"`
+	Idle     int64  `json:"idle"`
+}
+
+type statusVhost struct {
+	Name          string            `json:"name"`
+	Requests      uint64            `json:"requests"`
+	Codes         map[string]uint64 `json:"codes"`
+	BytesReceived int64             `json:"bytes_received"`
+	BytesSent     int64             `json:"bytes_sent"`
+	AvgTime       float64           `json:"avg_ms"`
+}
+
+type statusRequest struct {
+	ID       string  `json:"id"`
+	Client   string  `json:"client"`
+	Method   string  `json:"method"`
+	URI      string  `json:"uri"`
+	Vhost    string  `json:"vhost"`
+	Listener string  `json:"listener"`
+	Elapsed  float64 `json:"elapsed_ms"`
+	Upstream string  `json:"upstream,omitempty"`
+}
+
+// serverStatus 输出状态页，格式由 format 参数或 Accept 头部决定
+func (ctx *Context) serverStatus() *Response {
+	conf := ctx.Vhost.Status
+	if len(conf.Networks) > 0 && !netutil.ContainsIP(conf.Networks, net.ParseIP(ctx.Req.ClientIP())) {
+		return ErrorResponse(403, "Forbidden")
+	}
+	if ctx.Req.Method != "GET" && ctx.Req.Method != "HEAD" {
+		resp := ErrorResponse(405, "Method Not Allowed")
+		resp.Header("Allow: GET, HEAD")
+		return resp
+	}
+
+	report := newStatusReport(time.Now())
+	response := &Response{Code: 200}
+	response.Header("Cache-Control: no-store")
+	query, _ := url.ParseQuery(ctx.Req.Querys)
+	if statusFormat(query.Get("format"), ctx.Req.HeaderValues("Accept")) == "json" {
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			logger.Error.Println(err)
+			return ErrorResponse(500, "Internal Server Error")
+		}
+		response.Header("Content-Type: application/json")
+		response.Content = string(content) + "\n"
+		return response
+	}
+	response.Header("Content-Type: text/html; charset=utf-8")
+	response.Content = report.html()
+	return response
+}
+
+func statusFormat(format string, accept []string) string {
+	switch format {
+	case "html", "json":
+		return format
+	}
+	for _, value := range accept {
+		if strings.HasPrefix(value, "application/json") {
+			return "json"
+		}
+	}
+	return "html"
+}
+
+func newStatusReport(now time.Time) *statusReport {
+	report := &statusReport{
+		Version:    Version,
+		Start:      metrics.start,
+		Uptime:     int64(now.Sub(metrics.start) / time.Second),
+		Generation: config.Generation(),
+		Vhosts:     []statusVhost{},
+		Requests:   []statusRequest{},
+	}
+
+	active := inflight.list()
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].req.Start.Before(active[j].req.Start)
+	})
+	var upstream int64
+	for _, r := range active {
+		req := r.req
+		sr := statusRequest{
+			ID:       req.RequestID,
+			Client:   req.ClientIP(),
+			Method:   req.Method,
+			URI:      req.RequestURI,
+			Vhost:    r.vhost,
+			Listener: r.listener,
+			Elapsed:  float64(now.Sub(req.Start)/time.Microsecond) / 1000,
+			Upstream: r.upstream.Load().(string),
+		}
+		if sr.Upstream != "" {
+			upstream++
+		}
+		report.Requests = append(report.Requests, sr)
+	}
+
+	conns := &report.Connections
+	conns.Accepted = atomic.LoadUint64(&metrics.accepted)
+	conns.Reading = atomic.LoadInt64(&connStates[stateReading])
+	conns.Writing = atomic.LoadInt64(&connStates[stateActive]) - upstream
+	conns.Upstream = upstream
+	conns.Idle = atomic.LoadInt64(&connStates[stateNew]) + atomic.LoadInt64(&connStates[stateIdle])
+	if conns.Writing < 0 {
+		conns.Writing = 0
+	}
+	conns.Active = conns.Reading + conns.Writing + conns.Upstream + conns.Idle
+
+	for name, totals := range metrics.vhostSnapshot() {
+		sv := statusVhost{
+			Name:          name,
+			Requests:      totals.Requests,
+			Codes:         make(map[string]uint64, len(totals.Codes)),
+			BytesReceived: totals.BytesReceived,
+			BytesSent:     totals.BytesSent,
+		}
+		for i, n := range totals.Codes {
+			sv.Codes[strconv.Itoa(i+1)+"xx"] = n
+		}
+		if totals.Requests > 0 {
+			sv.AvgTime = float64(totals.Duration/time.Microsecond) / 1000 / float64(totals.Requests)
+		}
+		report.Vhosts = append(report.Vhosts, sv)
+	}
+	sort.Slice(report.Vhosts, func(i, j int) bool {
+		return report.Vhosts[i].Name < report.Vhosts[j].Name
+	})
+	return report
+}
+
+func (report *statusReport) html() string {
+	cell := func(s string) string {
+		if s == "" {
+			s = "-"
+		}
+		return "<td>" + html.EscapeString(s) + "</td>"
+	}
+	itoa := func(n int64) string {
+		return strconv.FormatInt(n, 10)
+	}
+	ms := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 1, 64) + " ms"
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>Bronya Status</title></head>\n<body><h1>Bronya Status</h1>\n")
+	sb.WriteString("<p>Started " + report.Start.Format("2006-01-02 15:04:05 -0700") + ", uptime " + (time.Duration(report.Uptime) * time.Second).String())
+	sb.WriteString(", config generation " + strconv.FormatUint(report.Generation, 10) + "</p>\n")
+
+	c := report.Connections
+	sb.WriteString("<h2>Connections</h2>\n<table>\n<tr><th>Accepted</th><th>Active</th><th>Reading</th><th>Writing</th><th>Upstream</th><th>Idle</th></tr>\n<tr>")
+	sb.WriteString(cell(strconv.FormatUint(c.Accepted, 10)) + cell(itoa(c.Active)) + cell(itoa(c.Reading)) + cell(itoa(c.Writing)) + cell(itoa(c.Upstream)) + cell(itoa(c.Idle)))
+	sb.WriteString("</tr>\n</table>\n")
+
+	sb.WriteString("<h2>Virtual hosts</h2>\n<table>\n<tr><th>Vhost</th><th>Requests</th><th>1xx</th><th>2xx</th><th>3xx</th><th>4xx</th><th>5xx</th><th>Received</th><th>Sent</th><th>Avg time</th></tr>\n")
+	for _, v := range report.Vhosts {
+		sb.WriteString("<tr>" + cell(v.Name) + cell(strconv.FormatUint(v.Requests, 10)))
+		for i := 1; i <= 5; i++ {
+			sb.WriteString(cell(strconv.FormatUint(v.Codes[strconv.Itoa(i)+"xx"], 10)))
+		}
+		sb.WriteString(cell(humanSize(v.BytesReceived)) + cell(humanSize(v.BytesSent)) + cell(ms(v.AvgTime)) + "</tr>\n")
+	}
+	sb.WriteString("</table>\n")
+
+	sb.WriteString("<h2>Requests in flight</h2>\n<table>\n<tr><th>ID</th><th>Client</th><th>Vhost</th><th>Request</th><th>Elapsed</th><th>Upstream</th></tr>\n")
+	for _, r := range report.Requests {
+		sb.WriteString("<tr>" + cell(r.ID) + cell(r.Client) + cell(r.Vhost) + cell(r.Method+" "+r.URI) + cell(ms(r.Elapsed)) + cell(r.Upstream) + "</tr>\n")
+	}
+	sb.WriteString("</table>\n<hr><address>Bronya/" + Version + "</address></body></html>\n")
+	return sb.String()
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/logger"
+)
+
+// handleSignals 第一次收到 SIGINT/SIGTERM 时平滑关闭，第二次立即退出，
+// 收到 SIGHUP 时重新加载配置，收到 SIGUSR1 时重新打开日志文件，收到 SIGUSR2 时启动新进程并平滑退出
+func handleSignals(srv *Server) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info.Println("Reloading config file...")
+			if err := srv.Reload(); err != nil {
+				logger.Error.Println("Reload failed, keeping the old config:\n" + err.Error())
+				continue
+			}
+			logger.Info.Println("Config reloaded, generation", config.Generation())
+		}
+	}()
+
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			if err := logger.Reopen(); err != nil {
+				logger.Error.Println("Reopening log files:", err)
+				continue
+			}
+			logger.Info.Println("Log files reopened")
+		}
+	}()
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+
+	for {
+		s := <-sig
+		if s != syscall.SIGUSR2 {
+			logger.Info.Println("Received", s, "shutting down...")
+			break
+		}
+
+		logger.Info.Println("Received", s, "upgrading...")
+		if err := srv.Upgrade(); err != nil {
+			logger.Error.Println("Upgrade failed:", err)
+			continue
+		}
+		logger.Info.Println("Handed over listeners, shutting down...")
+		break
+	}
+
+	go func() {
+		s := <-sig
+		logger.Warning.Println("Received", s, "terminating immediately")
+		srv.Close()
+	}()
+
+	timeout := time.Duration(config.Current().ShutdownTimeout) * time.Second
+	if err := srv.Shutdown(timeout); err != nil {
+		logger.Warning.Println(err)
+	}
+}
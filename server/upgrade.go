@@ -0,0 +1,236 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/logger"
+)
+
+// 继承 socket 使用的环境变量，文件描述符从 3 开始连续编号，与 systemd 约定一致
+const (
+	envListenFDs     = "BRONYA_LISTEN_FDS"
+	envListenFDNames = "BRONYA_LISTEN_FDNAMES"
+	envReadyFD       = "BRONYA_READY_FD"
+	listenFDsStart   = 3
+)
+
+// upgradeTimeout 等待新进程就绪的最长时间
+const upgradeTimeout = 30 * time.Second
+
+type inheritedListener struct {
+	names    []string
+	listener net.Listener
+}
+
+var (
+	inheritOnce  sync.Once
+	inheritMutex sync.Mutex
+	inherited    []*inheritedListener
+)
+
+// inheritListeners 读取父进程或 systemd socket activation 传递的监听 socket
+func inheritListeners() {
+	inheritOnce.Do(func() {
+		var count int
+		var names []string
+		if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err == nil && pid == os.Getpid() {
+			count, _ = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+			names = strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		} else if n, err := strconv.Atoi(os.Getenv(envListenFDs)); err == nil {
+			count = n
+			for _, name := range strings.Split(os.Getenv(envListenFDNames), ":") {
+				name, _ = url.QueryUnescape(name)
+				names = append(names, name)
+			}
+		}
+		for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", envListenFDs, envListenFDNames} {
+			os.Unsetenv(env)
+		}
+
+		for i := 0; i < count; i++ {
+			f := os.NewFile(uintptr(listenFDsStart+i), "listener")
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				logger.Warning.Println("Inherited fd", listenFDsStart+i, err)
+				continue
+			}
+
+			il := &inheritedListener{listener: l}
+			if i < len(names) && names[i] != "" {
+				il.names = append(il.names, names[i])
+			}
+			inherited = append(inherited, il)
+			logger.Info.Println("Inherited listener", l.Addr().Network()+"://"+l.Addr().String())
+		}
+	})
+}
+
+// takeInherited 查找与监听器配置匹配的继承 socket，先按名称再按地址匹配
+func takeInherited(ln *config.Listener) net.Listener {
+	inheritListeners()
+
+	inheritMutex.Lock()
+	defer inheritMutex.Unlock()
+	for i, il := range inherited {
+		if il.matches(ln) {
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			return il.listener
+		}
+	}
+	return nil
+}
+
+func (il *inheritedListener) matches(ln *config.Listener) bool {
+	for _, name := range il.names {
+		if name == ln.Name {
+			return true
+		}
+	}
+
+	addr := il.listener.Addr()
+	if addr.Network() != ln.Network() {
+		return false
+	}
+	if ln.Network() == "unix" {
+		return addr.String() == ln.Socket
+	}
+
+	want, err := net.ResolveTCPAddr("tcp", ln.Addr())
+	if err != nil {
+		return false
+	}
+	got, ok := addr.(*net.TCPAddr)
+	if !ok || got.Port != want.Port {
+		return false
+	}
+	if len(want.IP) == 0 || want.IP.IsUnspecified() {
+		return len(got.IP) == 0 || got.IP.IsUnspecified()
+	}
+	return got.IP.Equal(want.IP)
+}
+
+// closeInherited 关闭配置中未使用的继承 socket
+func closeInherited() {
+	inheritMutex.Lock()
+	defer inheritMutex.Unlock()
+	for _, il := range inherited {
+		logger.Warning.Println("Closing unused inherited listener", il.listener.Addr())
+		il.listener.Close()
+	}
+	inherited = nil
+}
+
+// notifyReady 通知父进程新进程已经开始服务
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	os.Unsetenv(envReadyFD)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Upgrade 启动新的可执行文件并将监听 socket 传递给它，
+// 新进程就绪后由调用者平滑关闭当前进程
+func (srv *Server) Upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	srv.mutex.Lock()
+	var files []*os.File
+	var names []string
+	var handed []*listener
+	for _, l := range srv.listeners {
+		fl, ok := l.raw.(filer)
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			srv.mutex.Unlock()
+			closeFiles(files)
+			return err
+		}
+		files = append(files, f)
+		names = append(names, url.QueryEscape(l.conf().Name))
+		handed = append(handed, l)
+	}
+	srv.mutex.Unlock()
+	defer closeFiles(files)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, "BRONYA_") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		envListenFDs+"="+strconv.Itoa(len(files)),
+		envListenFDNames+"="+strings.Join(names, ":"),
+		envReadyFD+"="+strconv.Itoa(listenFDsStart+len(files)),
+	)
+
+	procFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
+	procFiles = append(procFiles, w)
+	proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: procFiles,
+	})
+	w.Close()
+	if err != nil {
+		return err
+	}
+
+	// 新进程退出时管道被关闭，读取会立即返回
+	r.SetReadDeadline(time.Now().Add(upgradeTimeout))
+	buf := make([]byte, 1)
+	if n, err := r.Read(buf); n != 1 {
+		proc.Kill()
+		proc.Release()
+		if err == nil {
+			err = errors.New("no readiness notification")
+		}
+		return errors.New("server: new process failed to start: " + err.Error())
+	}
+	pid := proc.Pid
+	proc.Release()
+
+	// socket 文件已由新进程接管，关闭时不能删除
+	for _, l := range handed {
+		if ul, ok := l.raw.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	logger.Info.Println("New process", pid, "is ready")
+	return nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/kotoyuuko/bronya/config"
+	"github.com/kotoyuuko/bronya/server"
+)
+
+var signals = map[string]syscall.Signal{
+	"reload":  syscall.SIGHUP,
+	"reopen":  syscall.SIGUSR1,
+	"upgrade": syscall.SIGUSR2,
+	"stop":    syscall.SIGTERM,
+}
+
+// signalCommand 通过 pid 文件向运行中的服务器发送信号
+func signalCommand(name string) func([]string) int {
+	return func(args []string) int {
+		flags, path := newFlagSet(name)
+		pid := flags.String("p", "", "path to the pid file (overrides config)")
+		flags.Parse(args)
+
+		pidFile := *pid
+		if pidFile == "" {
+			conf, err := config.Decode(*path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, *path+":", err)
+				return 1
+			}
+			pidFile = conf.Pid
+		}
+
+		target, err := server.ReadPid(pidFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if err := syscall.Kill(target, signals[name]); err != nil {
+			fmt.Fprintln(os.Stderr, "pid", target, err)
+			return 1
+		}
+		return 0
+	}
+}